@@ -0,0 +1,130 @@
+package api
+
+import (
+	"net/http"
+	"strings"
+)
+
+// Challenge is an authentication challenge sent by the API
+// in a WWW-Authenticate header, like
+//
+//	Bearer realm="https://auth.example.com/token", scope="repo:read"
+type Challenge struct {
+	Scheme  string            // eg, "Bearer" or "Basic"
+	Params  map[string]string // auth parameters, with lower-case names (eg, "realm", "scope")
+	Token68 string            // used by some schemes instead of Params
+}
+
+// Realm returns the "realm" parameter of the challenge.
+func (c Challenge) Realm() string {
+	return c.Params["realm"]
+}
+
+// parseChallenges parses the challenges in the WWW-Authenticate header values.
+// Invalid parts are skipped.
+func parseChallenges(header http.Header) []Challenge {
+	var challenges []Challenge
+	for _, v := range header.Values("Www-Authenticate") {
+		challenges = append(challenges, parseChallenge(v)...)
+	}
+	return challenges
+}
+
+// parseChallenge parses the challenges in one WWW-Authenticate header value,
+// with the syntax in RFC 9110, section 11.6.1.
+func parseChallenge(s string) []Challenge {
+	var challenges []Challenge
+	var cur *Challenge
+	for {
+		s = strings.TrimLeft(s, " \t,")
+		if s == "" {
+			return challenges
+		}
+		name, rest := cutToken(s)
+		if name == "" {
+			// invalid character: skip it
+			s = s[1:]
+			continue
+		}
+		rest = strings.TrimLeft(rest, " \t")
+		if cur != nil && strings.HasPrefix(rest, "=") && !strings.HasPrefix(rest, "==") {
+			// auth-param
+			var value string
+			rest = strings.TrimLeft(rest[1:], " \t")
+			if strings.HasPrefix(rest, `"`) {
+				value, rest = cutQuoted(rest)
+			} else {
+				value, rest = cutToken(rest)
+			}
+			if cur.Params == nil {
+				cur.Params = make(map[string]string)
+			}
+			cur.Params[strings.ToLower(name)] = value
+			s = rest
+			continue
+		}
+		// new challenge
+		challenges = append(challenges, Challenge{Scheme: name})
+		cur = &challenges[len(challenges)-1]
+		s = rest
+		if t68, rest, ok := cutToken68(s); ok {
+			cur.Token68 = t68
+			cur = nil // a token68 is not followed by auth-params
+			s = rest
+		}
+	}
+}
+
+// isTokenChar reports whether c can be part of a token (RFC 9110, section 5.6.2).
+func isTokenChar(c byte) bool {
+	return c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' ||
+		strings.IndexByte("!#$%&'*+-.^_`|~", c) >= 0
+}
+
+// cutToken returns the token at the beginning of s and the rest of s.
+func cutToken(s string) (token, rest string) {
+	i := 0
+	for i < len(s) && isTokenChar(s[i]) {
+		i++
+	}
+	return s[:i], s[i:]
+}
+
+// cutQuoted returns the unescaped contents of the quoted string
+// at the beginning of s and the rest of s.
+func cutQuoted(s string) (value, rest string) {
+	var b strings.Builder
+	for i := 1; i < len(s); i++ {
+		switch s[i] {
+		case '"':
+			return b.String(), s[i+1:]
+		case '\\':
+			if i+1 < len(s) {
+				i++
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String(), ""
+}
+
+// cutToken68 returns the token68 at the beginning of s (after spaces),
+// if it is followed by the end of the challenge, and the rest of s.
+func cutToken68(s string) (token68, rest string, ok bool) {
+	s = strings.TrimLeft(s, " \t")
+	i := 0
+	for i < len(s) && (isTokenChar(s[i]) || s[i] == '/') {
+		i++
+	}
+	if i == 0 {
+		return "", s, false
+	}
+	for i < len(s) && s[i] == '=' {
+		i++
+	}
+	rest = strings.TrimLeft(s[i:], " \t")
+	if rest != "" && rest[0] != ',' {
+		return "", s, false
+	}
+	return s[:i], rest, true
+}
@@ -1,12 +1,21 @@
 package api
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"maps"
 	"net"
 	"net/http"
 	"net/url"
+	"slices"
+	"strings"
+	"time"
 )
 
 const (
@@ -16,18 +25,107 @@ const (
 
 // Client is a way to connect to 3rd party API servers.
 type Client struct {
-	apiEndPoint           string
+	base                  *url.URL // API end point
+	baseErr               error    // Error parsing the API end point, returned in every request
 	apiToken              string
 	headerToken           string // What header should we use to send the token (eg, "Authorization")
 	tokenPrefix           string // What to send before the token (eg, "Bearer", "Basic"...)
 	paramToken            string // What query parameter should we use to send the token (eg, "private_token")
+	basicAuth             string // base64-encoded "user:pass", if using HTTP Basic authentication
 	disallowUnknownFields bool
+	validateResponses     bool
+	noEscapeHTML          bool // Do not escape HTML characters in JSON requests
 	unixSocket            string
+	header                http.Header // Additional headers to send in every request
+	allowErrorStatus      bool        // Do not treat error status codes as errors in RequestReader
+	decompress            []string    // Content encodings to decompress in the responses
+	contentType           string      // Content-Type of the requests with a body
+	gzip                  bool        // Compress the body of the requests
+	timeout               time.Duration
+	requestTimeout        time.Duration // Timeout of a single request, set with the Timeout option
+	dialTimeout           time.Duration
+	transport             *http.Transport // Built for unixSocket and dialTimeout, reused by every request
+	client                *http.Client    // If not nil, used to send the requests
+	retries               int             // Max number of retries for idempotent requests
+	retryBase             time.Duration   // Base delay between retries
+	marshalFn             func(any) ([]byte, error)
+	unmarshalFn           func([]byte, any) error
+	requestHook           func(*http.Request)
+	responseHook          func(*http.Response, time.Duration)
+	verbose               io.Writer // If not nil, requests and responses are logged here
 }
 
 // NewClient creates a new Client ready to use.
+//
+// To connect through a Unix domain socket, apiEndPoint can have the form
+// "unix:///path/to/socket" or "http+unix:///path/to/socket", optionally
+// followed by ":/base/path" (eg, "http+unix:///run/app.sock:/v1").
+// The socket path can also be URL-encoded (eg, "http+unix://%2Frun%2Fapp.sock/v1").
+//
+// If apiEndPoint is not a valid URL, every request made with
+// the Client will fail.  Use ParseClient to detect it earlier.
 func NewClient(apiEndPoint string) *Client {
-	return &Client{apiEndPoint: apiEndPoint}
+	c, _ := ParseClient(apiEndPoint)
+	return c
+}
+
+// ParseClient is like NewClient, but it returns an error
+// if apiEndPoint is not a valid URL, along with the Client.
+func ParseClient(apiEndPoint string) (*Client, error) {
+	c := &Client{}
+	for _, scheme := range []string{"unix://", "http+unix://"} {
+		if rest, ok := strings.CutPrefix(apiEndPoint, scheme); ok {
+			var path string
+			c.unixSocket, path = unixSocketPath(rest)
+			c.transport = newTransport(c.unixSocket, c.dialTimeout)
+			apiEndPoint = "http://unix" + path
+			break
+		}
+	}
+	c.base, c.baseErr = url.Parse(apiEndPoint)
+	if c.baseErr == nil && (c.base.Scheme == "" || c.base.Host == "") {
+		c.baseErr = fmt.Errorf("api: invalid end point %q: it must be an absolute URL", apiEndPoint)
+	}
+	return c, c.baseErr
+}
+
+// unixSocketPath splits the part of a "unix://" or "http+unix://" URL
+// after the scheme into the socket path and the path of the API end point.
+func unixSocketPath(s string) (socket, path string) {
+	if !strings.HasPrefix(s, "/") {
+		// URL-encoded socket path, up to the first '/'
+		socket, path, _ = strings.Cut(s, "/")
+		if unescaped, err := url.PathUnescape(socket); err == nil {
+			socket = unescaped
+		}
+		return socket, "/" + path
+	}
+	socket, path, _ = strings.Cut(s, ":")
+	return socket, path
+}
+
+// Clone returns a copy of the Client, with the same configuration.
+// The methods with names beginning with "With" already return a copy,
+// so they can be called on the result without modifying c.
+//
+// The configuration is copied (including the extra headers),
+// but these values are shared by both clients:
+//   - the *http.Client set with WithHTTPClient, with its Transport
+//   - the transport used for Unix sockets and WithDialTimeout,
+//     so both clients use the same pool of connections
+//   - the functions set with WithRequestHook, WithResponseHook and WithMarshaler,
+//     along with any state they use
+//   - the io.Writer set with WithVerbose
+func (c *Client) Clone() *Client {
+	c2 := new(Client)
+	*c2 = *c
+	if c.base != nil {
+		base := *c.base
+		c2.base = &base
+	}
+	c2.header = c.header.Clone()
+	c2.decompress = slices.Clone(c.decompress)
+	return c2
 }
 
 // WithToken adds a token to a Client.
@@ -62,6 +160,16 @@ func (c *Client) WithParamToken(pt string) *Client {
 	return c2
 }
 
+// WithBasicAuth causes the Client to use HTTP Basic authentication
+// with the provided user name and password.
+// If the Client also has a token, basic authentication wins and the token is not sent.
+func (c *Client) WithBasicAuth(user, pass string) *Client {
+	c2 := new(Client)
+	*c2 = *c
+	c2.basicAuth = base64.StdEncoding.EncodeToString([]byte(user + ":" + pass))
+	return c2
+}
+
 // DisallowUnknownFields causes the JSON decoder to return an error when the
 // destination is a struct and the input contains object keys which do not
 // match any non-ignored, exported fields in the destination.
@@ -72,118 +180,1017 @@ func (c *Client) DisallowUnknownFields() *Client {
 	return c2
 }
 
+// ValidateResponses causes the Client to call the Validate method of
+// the destination of every decoded response, if it implements Validator,
+// and return its error.
+func (c *Client) ValidateResponses() *Client {
+	c2 := new(Client)
+	*c2 = *c
+	c2.validateResponses = true
+	return c2
+}
+
+// WithEscapeHTML specifies whether problematic HTML characters
+// (<, > and &) should be escaped inside JSON quoted strings in the requests.
+// The default is true.
+func (c *Client) WithEscapeHTML(on bool) *Client {
+	c2 := new(Client)
+	*c2 = *c
+	c2.noEscapeHTML = !on
+	return c2
+}
+
 // WithUnixSocket causes the client to connect through this Unix domain socket,
 // instead of using the network.
 func (c *Client) WithUnixSocket(socket string) *Client {
 	c2 := new(Client)
 	*c2 = *c
 	c2.unixSocket = socket
+	c2.transport = newTransport(c2.unixSocket, c2.dialTimeout)
+	return c2
+}
+
+// WithHeader adds a header line to all the requests made by the Client.
+// Calling it several times with the same key adds several values,
+// like http.Header.Add.  It does not replace the header used for the token.
+func (c *Client) WithHeader(key, value string) *Client {
+	c2 := new(Client)
+	*c2 = *c
+	c2.header = c.header.Clone()
+	if c2.header == nil {
+		c2.header = make(http.Header)
+	}
+	c2.header.Add(key, value)
+	return c2
+}
+
+// WithDecompression causes the Client to decompress the responses
+// with any of these content encodings (eg, "br", "zstd").
+// Encodings other than "gzip" and "deflate" must be registered with RegisterDecompressor.
+//
+// If there is no Accept-Encoding header (see WithHeader), it is set to these encodings,
+// skipping the ones without a registered decompressor when the request is sent.
+// By default, only gzip is requested.  Responses with "Content-Encoding: gzip"
+// are always decompressed.
+func (c *Client) WithDecompression(encodings ...string) *Client {
+	c2 := new(Client)
+	*c2 = *c
+	c2.decompress = slices.Clone(encodings)
+	return c2
+}
+
+// WithAcceptEncoding sets the Accept-Encoding header of the requests
+// to these content encodings (eg, "gzip"), and causes the Client
+// to decompress the responses using any of them, like WithDecompression.
+//
+// Setting the Accept-Encoding header with WithHeader or Header
+// disables the transparent decompression done by net/http,
+// so the body of the responses would be returned compressed.
+// Use WithAcceptEncoding instead.
+func (c *Client) WithAcceptEncoding(encodings ...string) *Client {
+	c2 := c.WithDecompression(encodings...)
+	c2.header = c.header.Clone()
+	if c2.header == nil {
+		c2.header = make(http.Header)
+	}
+	c2.header.Set("Accept-Encoding", strings.Join(encodings, ", "))
+	return c2
+}
+
+// WithContentType sets the Content-Type header sent in the requests.
+// By default, it is "application/json" when the data is encoded as JSON,
+// and it is not sent when the data is a []byte or an io.Reader.
+func (c *Client) WithContentType(ct string) *Client {
+	c2 := new(Client)
+	*c2 = *c
+	c2.contentType = ct
+	return c2
+}
+
+// WithGzip causes the Client to compress the body of the requests with gzip,
+// sending a "Content-Encoding: gzip" header.
+func (c *Client) WithGzip() *Client {
+	c2 := new(Client)
+	*c2 = *c
+	c2.gzip = true
+	return c2
+}
+
+// WithTimeout sets a time limit for the requests made by this Client.
+// The timeout includes connection time, any redirects, and reading the response body.
+// A timeout of zero means no timeout.
+//
+// It can be overridden for a single request with the Timeout option.
+func (c *Client) WithTimeout(d time.Duration) *Client {
+	c2 := new(Client)
+	*c2 = *c
+	c2.timeout = d
+	return c2
+}
+
+// WithDialTimeout sets a time limit to establish the connections to the API server,
+// independent of the overall timeout set with WithTimeout.
+// A timeout of zero means no specific limit.
+//
+// If the Client uses a *http.Client (see WithHTTPClient), it must not have a Transport.
+func (c *Client) WithDialTimeout(d time.Duration) *Client {
+	c2 := new(Client)
+	*c2 = *c
+	c2.dialTimeout = d
+	c2.transport = newTransport(c2.unixSocket, c2.dialTimeout)
+	return c2
+}
+
+// WithHTTPClient causes the Client to use this *http.Client to send all the requests,
+// instead of creating a new one each time.
+//
+// If the Client uses a Unix domain socket (see WithUnixSocket)
+// or a dial timeout (see WithDialTimeout), client must not have a Transport.
+func (c *Client) WithHTTPClient(client *http.Client) *Client {
+	c2 := new(Client)
+	*c2 = *c
+	c2.client = client
+	return c2
+}
+
+// WithRetry causes the Client to retry idempotent requests (GET, HEAD, PUT and DELETE)
+// up to max times if there is a connection error or the response status
+// is 429 Too Many Requests or 503 Service Unavailable.
+//
+// The delay before every retry is taken from the Retry-After header if present;
+// otherwise it starts at base and doubles with every attempt, with some random jitter.
+//
+// If the request fails after being retried, the error is a *RetryError.
+// Retries can be disabled for a single request using the NoRetry option.
+func (c *Client) WithRetry(max int, base time.Duration) *Client {
+	c2 := new(Client)
+	*c2 = *c
+	c2.retries = max
+	c2.retryBase = base
+	return c2
+}
+
+// WithMarshaler causes the Client to use these functions instead of
+// json.Marshal and json.Unmarshal to encode the requests and decode the responses,
+// for example to use a faster JSON library.
+// Either of them can be nil to keep using encoding/json.
+//
+// WithEscapeHTML does not apply to a custom marshal function,
+// and DisallowUnknownFields does not apply to a custom unmarshal function:
+// they should be configured in the library used, if it supports them.
+func (c *Client) WithMarshaler(marshal func(any) ([]byte, error), unmarshal func([]byte, any) error) *Client {
+	c2 := new(Client)
+	*c2 = *c
+	c2.marshalFn = marshal
+	c2.unmarshalFn = unmarshal
+	return c2
+}
+
+// WithRequestHook causes the Client to call hook with every request,
+// after building its URL and headers and before sending it
+// (eg, to log it).  If a request is retried, hook is called for every attempt.
+func (c *Client) WithRequestHook(hook func(*http.Request)) *Client {
+	c2 := new(Client)
+	*c2 = *c
+	c2.requestHook = hook
+	return c2
+}
+
+// WithResponseHook causes the Client to call hook with every response
+// as soon as it arrives, before reading its body, along with the time
+// elapsed since the request was sent (eg, for logging or metrics).
+// If a request is retried, hook is called for every response received.
+func (c *Client) WithResponseHook(hook func(*http.Response, time.Duration)) *Client {
+	c2 := new(Client)
+	*c2 = *c
+	c2.responseHook = hook
+	return c2
+}
+
+// WithVerbose causes the Client to write the method, URL and headers
+// of every request, and the status and headers of every response, to w,
+// in a format similar to "curl -v":
+//
+//	> GET http://localhost:8080/users
+//	> Accept: application/json
+//	>
+//	< HTTP/1.1 200 OK
+//	< Content-Type: application/json
+//	<
+//
+// The bodies are not written, and the credentials (the Authorization header,
+// and the header or query parameter used to send the token) are redacted.
+func (c *Client) WithVerbose(w io.Writer) *Client {
+	c2 := new(Client)
+	*c2 = *c
+	c2.verbose = w
+	return c2
+}
+
+// verboseRedacted replaces the credentials written by WithVerbose.
+const verboseRedacted = "[REDACTED]"
+
+// writeVerbose writes a header in the format used by WithVerbose,
+// with every line preceded by prefix.  The values of the redact headers are hidden.
+func writeVerbose(w io.Writer, prefix string, header http.Header, redact ...string) {
+	for _, k := range slices.Sorted(maps.Keys(header)) {
+		for _, v := range header[k] {
+			if slices.ContainsFunc(redact, func(h string) bool { return strings.EqualFold(h, k) }) {
+				v = verboseRedacted
+			}
+			fmt.Fprintf(w, "%s %s: %s\n", prefix, k, v)
+		}
+	}
+	fmt.Fprintf(w, "%s\n", prefix)
+}
+
+// RequestOption modifies the behaviour of a single request made by a Client.
+// Options are applied to a copy of the Client used only for that request.
+type RequestOption func(*Client)
+
+// Header is a RequestOption that adds a header line to the request,
+// like Client.WithHeader.
+func Header(key, value string) RequestOption {
+	return func(c *Client) {
+		if c.header == nil {
+			c.header = make(http.Header)
+		}
+		c.header.Add(key, value)
+	}
+}
+
+// Token is a RequestOption that uses a different token for the request.
+func Token(tk string) RequestOption {
+	return func(c *Client) {
+		c.apiToken = tk
+	}
+}
+
+// NoRetry is a RequestOption that disables the retries for this request,
+// even if the Client has been configured to retry requests with WithRetry.
+// Use it for requests which must never be sent more than once.
+func NoRetry() RequestOption {
+	return func(c *Client) {
+		c.retries = 0
+	}
+}
+
+// Timeout is a RequestOption that sets a time limit for this request,
+// overriding the one set with Client.WithTimeout, if any.
+// The request context is given a deadline, which also applies to reading the body
+// of the response.  A timeout of zero means no timeout for this request.
+func Timeout(d time.Duration) RequestOption {
+	return func(c *Client) {
+		c.timeout = 0
+		c.requestTimeout = d
+	}
+}
+
+// AllowErrorStatus is a RequestOption that causes RequestReader to return
+// the body of responses with an error status code (4xx or 5xx) instead of an error,
+// so the caller can inspect them.
+func AllowErrorStatus() RequestOption {
+	return func(c *Client) {
+		c.allowErrorStatus = true
+	}
+}
+
+// with returns a copy of c with the options applied,
+// or c itself if there are no options.
+func (c *Client) with(opts []RequestOption) *Client {
+	if len(opts) == 0 {
+		return c
+	}
+	c2 := new(Client)
+	*c2 = *c
+	c2.header = c.header.Clone()
+	for _, opt := range opts {
+		opt(c2)
+	}
 	return c2
 }
 
 // Request makes a HTTP request to the API.
-// If data is not a []byte, it will be encoding as a JSON object.
-func (c *Client) Request(method, URL string, data any, dest any) error {
+// If data is a []byte, it is sent as is.
+// If it is a json.RawMessage, it is sent as is, as already-encoded JSON.
+// If it is an io.Reader, it is read and sent without buffering (and the request is never retried).
+// Otherwise, it is encoded as JSON.
+//
+// If dest is a *[]byte, it receives the raw body of the response;
+// if it is a ByStatus, it depends on the status code of the response;
+// otherwise, the response is decoded as JSON into dest.
+func (c *Client) Request(method, URL string, data any, dest any, opts ...RequestOption) error {
+	return c.RequestContext(context.Background(), method, URL, data, dest, opts...)
+}
+
+// RequestContext is like Request, using the provided context.
+// If the context is cancelled, the request is aborted and the context's error is returned,
+// even if the response is being read.
+func (c *Client) RequestContext(ctx context.Context, method, URL string, data any, dest any, opts ...RequestOption) error {
+	c = c.with(opts)
+	resp, err := c.do(ctx, method, URL, data)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	err = c.readResponse(resp, dest)
+	if err != nil && ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+// readResponse decodes the body of a successful response into dest
+// (see Request).
+func (c *Client) readResponse(resp *http.Response, dest any) error {
 	var err error
-	var b []byte
-	switch d := data.(type) {
-	case []byte:
-		b = d
-	default:
-		b, err = json.Marshal(data)
+	dest = destForStatus(dest, resp.StatusCode)
+	if b, ok := dest.(*[]byte); ok {
+		*b, err = io.ReadAll(resp.Body)
+		return err
+	}
+	// 204 No Content, or any other empty body: nothing to decode
+	body := bufio.NewReader(resp.Body)
+	if _, err := body.Peek(1); resp.StatusCode == http.StatusNoContent || err == io.EOF {
+		return nil
+	}
+	if dest == nil {
+		var foo any
+		dest = &foo
+	}
+	return c.decode(c.newDecoder(body), dest)
+}
+
+// ByStatus can be used as the dest of Client.Request and Client.RequestFull
+// (and the methods using them) when the body of the response has
+// a different shape depending on its status code.  The body is decoded
+// into the value for its status code, or the value for 0 if there is none.
+// If there is neither, the body is discarded.
+//
+//	var job Job
+//	var pending Pending
+//	err := c.Post("/jobs", req, api.ByStatus{200: &job, 202: &pending})
+//
+// Only the responses without an error status code are decoded;
+// errors are returned as usual.
+type ByStatus map[int]any
+
+// destForStatus returns the value where the body of a response
+// with the given status code must be decoded.
+func destForStatus(dest any, status int) any {
+	bs, ok := dest.(ByStatus)
+	if !ok {
+		return dest
+	}
+	if d, ok := bs[status]; ok {
+		return d
+	}
+	return bs[0]
+}
+
+// Response contains the status code, headers and body of
+// the response to a request made by a Client.
+type Response struct {
+	StatusCode int
+	Header     http.Header
+	Attempts   int // Number of times the request was sent, including the last one (see WithRetry)
+	body       []byte
+	raw        *http.Response
+}
+
+// Bytes returns the body of the response.
+// It is nil for responses returned by RequestReader.
+func (r *Response) Bytes() []byte {
+	return r.body
+}
+
+// Raw returns the underlying *http.Response, to access the information
+// not available in Response (like the trailers or the TLS connection state).
+//
+// Its body has already been consumed: it is the same as Bytes,
+// and closing it is not needed.  In responses returned by RequestReader,
+// it is the same stream returned by RequestReader.
+func (r *Response) Raw() *http.Response {
+	return r.raw
+}
+
+// Cookies parses and returns the cookies set in the Set-Cookie headers
+// of the response, to be used without a cookie jar
+// (eg, to get the session token after a login).
+func (r *Response) Cookies() []*http.Cookie {
+	return (&http.Response{Header: r.Header}).Cookies()
+}
+
+// RequestFull makes a HTTP request to the API, like Request,
+// and returns the response status code, headers and body.
+//
+// If the response has an error status code, RequestFull returns
+// both the Response and an error.
+func (c *Client) RequestFull(method, URL string, data any, dest any, opts ...RequestOption) (*Response, error) {
+	return c.RequestFullContext(context.Background(), method, URL, data, dest, opts...)
+}
+
+// RequestFullContext is like RequestFull, using the provided context.
+func (c *Client) RequestFullContext(ctx context.Context, method, URL string, data any, dest any, opts ...RequestOption) (*Response, error) {
+	c = c.with(opts)
+	resp, attempts, err := c.send(ctx, method, URL, data)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	r := &Response{
+		StatusCode: resp.StatusCode,
+		Header:     resp.Header,
+		Attempts:   attempts,
+		body:       body,
+		raw:        resp,
+	}
+	if resp.StatusCode >= 400 {
+		return r, retryError(attempts, statusError(resp, body))
+	}
+	dest = destForStatus(dest, resp.StatusCode)
+	if b, ok := dest.(*[]byte); ok {
+		*b = body
+		return r, nil
+	}
+	if dest != nil && len(body) > 0 {
+		if err := c.decode(c.newDecoder(bytes.NewReader(body)), dest); err != nil {
+			return r, err
+		}
+	}
+	return r, nil
+}
+
+// RequestReader makes a HTTP request to the API and returns the body of
+// the response without decoding it, along with its status code and headers.
+// The caller must close the returned body.
+//
+// If the response has an error status code, its body is closed and
+// an error is returned, unless the AllowErrorStatus option is used.
+func (c *Client) RequestReader(method, URL string, data any, opts ...RequestOption) (io.ReadCloser, *Response, error) {
+	return c.RequestReaderContext(context.Background(), method, URL, data, opts...)
+}
+
+// RequestReaderContext is like RequestReader, using the provided context.
+func (c *Client) RequestReaderContext(ctx context.Context, method, URL string, data any, opts ...RequestOption) (io.ReadCloser, *Response, error) {
+	c = c.with(opts)
+	resp, attempts, err := c.send(ctx, method, URL, data)
+	if err != nil {
+		return nil, nil, err
+	}
+	r := &Response{
+		StatusCode: resp.StatusCode,
+		Header:     resp.Header,
+		Attempts:   attempts,
+		raw:        resp,
+	}
+	if resp.StatusCode >= 400 && !c.allowErrorStatus {
+		r.body, _ = io.ReadAll(resp.Body)
+		resp.Body.Close()
+		resp.Body = io.NopCloser(bytes.NewReader(r.body))
+		return nil, r, retryError(attempts, statusError(resp, r.body))
+	}
+	return resp.Body, r, nil
+}
+
+// Stream makes a HTTP request to the API and returns the live body of
+// the response for the caller to read and close, without buffering it,
+// which is useful for very large downloads.  It is the same as RequestReader.
+func (c *Client) Stream(method, URL string, data any, opts ...RequestOption) (io.ReadCloser, *Response, error) {
+	return c.RequestReader(method, URL, data, opts...)
+}
+
+// GetReader makes a HTTP GET request to the API and returns the body
+// of the response without decoding it.  See RequestReader.
+func (c *Client) GetReader(url string, opts ...RequestOption) (io.ReadCloser, *Response, error) {
+	return c.RequestReader("GET", url, []byte(nil), opts...)
+}
+
+// PostReader makes a HTTP POST request to the API and returns the body
+// of the response without decoding it.  See RequestReader.
+func (c *Client) PostReader(url string, data any, opts ...RequestOption) (io.ReadCloser, *Response, error) {
+	return c.RequestReader("POST", url, data, opts...)
+}
+
+// DecodeArray makes a HTTP request to the API, expecting a JSON array
+// as a response, and calls elem once for every element in that array,
+// without reading the whole response in memory.
+//
+// elem receives a function decode that can be used (at most once)
+// to decode the current element.  If elem does not call it, the element is skipped.
+// If elem returns an error, DecodeArray stops and returns that error.
+func (c *Client) DecodeArray(method, URL string, data any, elem func(decode func(any) error) error, opts ...RequestOption) error {
+	return c.DecodeArrayContext(context.Background(), method, URL, data, elem, opts...)
+}
+
+// DecodeArrayContext is like DecodeArray, using the provided context.
+// If the context is cancelled, it stops and returns the context's error.
+func (c *Client) DecodeArrayContext(ctx context.Context, method, URL string, data any, elem func(decode func(any) error) error, opts ...RequestOption) error {
+	c = c.with(opts)
+	resp, err := c.do(ctx, method, URL, data)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	decoder := c.newDecoder(resp.Body)
+	tok, err := decoder.Token()
+	if err != nil {
+		return err
+	}
+	if tok == nil {
+		// null: no elements
+		return nil
+	}
+	if delim, ok := tok.(json.Delim); !ok || delim != '[' {
+		return fmt.Errorf("api: expected JSON array, got %v", tok)
+	}
+	for decoder.More() {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		decoded := false
+		err := elem(func(v any) error {
+			if decoded {
+				return errors.New("api: decode called more than once")
+			}
+			decoded = true
+			return c.decode(decoder, v)
+		})
 		if err != nil {
 			return err
 		}
+		if !decoded {
+			var skip json.RawMessage
+			if err := decoder.Decode(&skip); err != nil {
+				return err
+			}
+		}
+	}
+	// closing ']'
+	if _, err := decoder.Token(); err != nil {
+		return err
+	}
+	return nil
+}
+
+// marshal returns the JSON encoding of v, according to the Client options.
+func (c *Client) marshal(v any) ([]byte, error) {
+	if c.marshalFn != nil {
+		return c.marshalFn(v)
+	}
+	if !c.noEscapeHTML {
+		return json.Marshal(v)
+	}
+	var buf bytes.Buffer
+	e := json.NewEncoder(&buf)
+	e.SetEscapeHTML(false)
+	if err := e.Encode(v); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), nil
+}
+
+// Validator is implemented by types which can check their own contents.
+type Validator interface {
+	Validate() error
+}
+
+// decode decodes the next JSON value from decoder into dest,
+// with the unmarshal function set with WithMarshaler if any,
+// and validates it if needed (see ValidateResponses).
+func (c *Client) decode(decoder *json.Decoder, dest any) error {
+	if c.unmarshalFn != nil {
+		// decoder is only used to find the end of the value
+		var raw json.RawMessage
+		if err := decoder.Decode(&raw); err != nil {
+			return err
+		}
+		if err := c.unmarshalFn(raw, dest); err != nil {
+			return err
+		}
+	} else if err := decoder.Decode(dest); err != nil {
+		return err
+	}
+	if v, ok := dest.(Validator); ok && c.validateResponses {
+		return v.Validate()
+	}
+	return nil
+}
+
+// newDecoder returns a JSON decoder configured with the Client options.
+func (c *Client) newDecoder(r io.Reader) *json.Decoder {
+	decoder := json.NewDecoder(r)
+	if c.disallowUnknownFields {
+		decoder.DisallowUnknownFields()
+	}
+	return decoder
+}
+
+// URL returns the absolute URL of a path relative to the API end point,
+// like the ones used in the requests, with params added to its query.
+// It does not include the token, even if it is sent as a query parameter.
+func (c *Client) URL(path string, params url.Values) (*url.URL, error) {
+	u, err := c.resolve(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(params) > 0 {
+		if u.RawQuery != "" {
+			u.RawQuery += "&"
+		}
+		u.RawQuery += params.Encode()
+	}
+	return u, nil
+}
+
+// resolve returns the URL of a path relative to the API end point.
+// path can contain a query, which is added to the one in the end point, if any.
+func (c *Client) resolve(path string) (*url.URL, error) {
+	if c.baseErr != nil {
+		return nil, c.baseErr
+	}
+	path, rawQuery, _ := strings.Cut(path, "?")
+	u := c.base.JoinPath(path)
+	if rawQuery != "" {
+		if u.RawQuery != "" {
+			u.RawQuery += "&"
+		}
+		u.RawQuery += rawQuery
+	}
+	return u, nil
+}
+
+// urlAndHeader returns the URL and the HTTP headers to be used
+// in a request to the API, including the token if there is any.
+func (c *Client) urlAndHeader(URL string) (*url.URL, http.Header, error) {
+	apiToken := c.apiToken
+	if c.basicAuth != "" {
+		apiToken = ""
 	}
 
 	// make headerToken and tokenPrefix the default values if needed, but only for this call.
 	headerToken, tokenPrefix := c.headerToken, c.tokenPrefix
-	if c.apiToken != "" && headerToken == "" && c.paramToken == "" {
+	if apiToken != "" && headerToken == "" && c.paramToken == "" {
 		headerToken = defaultHeaderToken
 		if tokenPrefix == "" {
 			tokenPrefix = defaultTokenPrefix
 		}
 	}
 
-	u, err := url.Parse(c.apiEndPoint)
+	u, err := c.resolve(URL)
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
-	u = u.JoinPath(URL)
-	if c.apiToken != "" && c.paramToken != "" {
+	if apiToken != "" && c.paramToken != "" {
 		v, err := url.ParseQuery(u.RawQuery)
 		if err != nil {
-			return err
+			return nil, nil, err
 		}
-		v.Add(c.paramToken, c.apiToken)
+		v.Add(c.paramToken, apiToken)
 		u.RawQuery = v.Encode()
 	}
 
-	req, err := http.NewRequest(method, u.String(), bytes.NewBuffer(b))
-	if err != nil {
-		return err
+	header := c.header.Clone()
+	if header == nil {
+		header = make(http.Header)
 	}
-	if c.apiToken != "" && headerToken != "" {
-		token := c.apiToken
+	if apiToken != "" && headerToken != "" {
+		token := apiToken
 		if tokenPrefix != "" {
 			token = tokenPrefix + " " + token
 		}
-		req.Header.Set(headerToken, token)
+		header.Set(headerToken, token)
 	}
+	if c.basicAuth != "" {
+		header.Set("Authorization", "Basic "+c.basicAuth)
+	}
+	if header.Get("Accept-Encoding") == "" {
+		var accepted []string
+		for _, e := range c.decompress {
+			if getDecompressor(e) != nil {
+				accepted = append(accepted, e)
+			}
+		}
+		if len(accepted) > 0 {
+			header.Set("Accept-Encoding", strings.Join(accepted, ", "))
+		}
+	}
+	return u, header, nil
+}
+
+// httpClient returns the *http.Client to be used to send a request.
+func (c *Client) httpClient() (*http.Client, error) {
 	client := &http.Client{}
-	if c.unixSocket != "" {
-		client.Transport = &http.Transport{
-			Dial: func(proto, addr string) (conn net.Conn, err error) {
-				return net.Dial("unix", c.unixSocket)
-			},
+	if c.client != nil {
+		if c.timeout == 0 && c.unixSocket == "" && c.dialTimeout == 0 {
+			return c.client, nil
 		}
+		// make a copy to avoid modifying the caller's client
+		*client = *c.client
+	}
+	if c.timeout != 0 {
+		client.Timeout = c.timeout
 	}
-	resp, err := client.Do(req)
+	if c.unixSocket != "" || c.dialTimeout != 0 {
+		if client.Transport != nil {
+			return nil, errors.New("api: cannot use a Unix socket or a dial timeout with a http.Client which already has a Transport")
+		}
+		client.Transport = c.transport
+	}
+	return client, nil
+}
+
+// newTransport returns a *http.Transport which connects through
+// the Unix domain socket, if not empty, with a dial timeout.
+// It is built once for every configuration, so the connections are reused.
+func newTransport(socket string, dialTimeout time.Duration) *http.Transport {
+	if socket == "" && dialTimeout == 0 {
+		return nil
+	}
+	dialer := &net.Dialer{Timeout: dialTimeout}
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if socket != "" {
+			return dialer.DialContext(ctx, "unix", socket)
+		}
+		return dialer.DialContext(ctx, network, addr)
+	}
+	return t
+}
+
+// do sends a HTTP request to the API and returns its response.
+// If the response has an error status code, its body is closed
+// and an error is returned.
+func (c *Client) do(ctx context.Context, method, URL string, data any) (*http.Response, error) {
+	resp, attempts, err := c.send(ctx, method, URL, data)
 	if err != nil {
-		return fmt.Errorf("api: %v", err)
+		return nil, err
 	}
-	defer resp.Body.Close()
 	if resp.StatusCode >= 400 {
-		var foo struct {
-			Error string
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return nil, retryError(attempts, statusError(resp, body))
+	}
+	return resp, nil
+}
+
+// send sends a HTTP request to the API, retrying it if needed,
+// and returns its response and the number of attempts made.
+// The status code of the response is not checked.
+//
+// If the request has its own timeout, the deadline lasts
+// until the body of the response is closed.
+func (c *Client) send(ctx context.Context, method, URL string, data any) (*http.Response, int, error) {
+	if c.requestTimeout <= 0 {
+		return c.sendAttempts(ctx, method, URL, data)
+	}
+	ctx, cancel := context.WithTimeout(ctx, c.requestTimeout)
+	resp, attempts, err := c.sendAttempts(ctx, method, URL, data)
+	if err != nil {
+		cancel()
+		return nil, attempts, err
+	}
+	resp.Body = cancelBody{resp.Body, cancel}
+	return resp, attempts, nil
+}
+
+// cancelBody is the body of a response whose context
+// must be cancelled when it is closed.
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b cancelBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
+// sendAttempts does the work of send.
+func (c *Client) sendAttempts(ctx context.Context, method, URL string, data any) (*http.Response, int, error) {
+	var err error
+	var b []byte
+	var body io.Reader
+	contentType := c.contentType
+	switch d := data.(type) {
+	case []byte:
+		b = d
+	case json.RawMessage:
+		b = d
+		if contentType == "" {
+			contentType = "application/json"
 		}
-		decoder := json.NewDecoder(resp.Body)
-		decoder.DisallowUnknownFields()
-		if err := decoder.Decode(dest); err != nil {
-			return fmt.Errorf("%s", resp.Status)
+	case io.Reader:
+		body = d
+	default:
+		b, err = c.marshal(data)
+		if err != nil {
+			return nil, 0, err
+		}
+		if contentType == "" {
+			contentType = "application/json"
 		}
-		return fmt.Errorf("%s: %s", resp.Status, foo.Error)
 	}
-	if dest == nil {
-		var foo any
-		dest = &foo
+
+	u, header, err := c.urlAndHeader(URL)
+	if err != nil {
+		return nil, 0, err
 	}
-	decoder := json.NewDecoder(resp.Body)
-	if c.disallowUnknownFields {
-		decoder.DisallowUnknownFields()
+	if contentType != "" && header.Get("Content-Type") == "" {
+		header.Set("Content-Type", contentType)
 	}
-	if err := decoder.Decode(dest); err != nil {
-		return err
+	if c.gzip && (body != nil || len(b) > 0) {
+		if body != nil {
+			body = gzipReader(body)
+		} else if b, err = gzipBytes(b); err != nil {
+			return nil, 0, err
+		}
+		header.Set("Content-Encoding", "gzip")
 	}
-	return nil
+	client, err := c.httpClient()
+	if err != nil {
+		return nil, 0, err
+	}
+	attempts := 1
+	if c.retries > 0 && idempotent(method) && body == nil {
+		attempts += c.retries
+	}
+	for attempt := 1; ; attempt++ {
+		reqBody := body
+		if reqBody == nil {
+			reqBody = bytes.NewReader(b)
+		}
+		req, err := http.NewRequestWithContext(ctx, method, u.String(), reqBody)
+		if err != nil {
+			return nil, 0, err
+		}
+		req.Header = header.Clone()
+		if c.requestHook != nil {
+			c.requestHook(req)
+		}
+		if c.verbose != nil {
+			u := *req.URL
+			if c.paramToken != "" && u.Query().Has(c.paramToken) {
+				q := u.Query()
+				q.Set(c.paramToken, verboseRedacted)
+				u.RawQuery = q.Encode()
+			}
+			fmt.Fprintf(c.verbose, "> %s %s\n", req.Method, &u)
+			writeVerbose(c.verbose, ">", req.Header, "Authorization", "Proxy-Authorization", c.headerToken)
+		}
+		start := time.Now()
+		resp, err := client.Do(req)
+		if resp != nil && c.responseHook != nil {
+			c.responseHook(resp, time.Since(start))
+		}
+		if resp != nil && c.verbose != nil {
+			fmt.Fprintf(c.verbose, "< %s %s\n", resp.Proto, resp.Status)
+			writeVerbose(c.verbose, "<", resp.Header)
+		}
+		if attempt < attempts && ctx.Err() == nil && shouldRetry(resp, err) {
+			wait := c.retryDelay(attempt, resp)
+			if resp != nil {
+				io.Copy(io.Discard, resp.Body)
+				resp.Body.Close()
+			}
+			select {
+			case <-time.After(wait):
+				continue
+			case <-ctx.Done():
+				return nil, attempt, ctx.Err()
+			}
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, attempt, ctx.Err()
+			}
+			return nil, attempt, retryError(attempt, fmt.Errorf("api: %v", err))
+		}
+		if err := decompressResponse(resp, c.decompress); err != nil {
+			resp.Body.Close()
+			return nil, attempt, err
+		}
+		return resp, attempt, nil
+	}
+}
+
+// APIError is the error returned by a Client when the response
+// from the API has an error status code (4xx or 5xx).
+type APIError struct {
+	StatusCode int
+	Status     string // eg, "404 Not Found"
+	Message    string // "error" field in the response, if any
+	Body       []byte // raw body of the response
+
+	// Challenges are the authentication challenges
+	// in the WWW-Authenticate header, if any.
+	Challenges []Challenge
+}
+
+func (e *APIError) Error() string {
+	if e.Message == "" {
+		return e.Status
+	}
+	return e.Status + ": " + e.Message
+}
+
+// statusError returns the error corresponding to a response
+// with an error status code and the given body.
+func statusError(resp *http.Response, body []byte) error {
+	e := &APIError{
+		StatusCode: resp.StatusCode,
+		Status:     resp.Status,
+		Body:       body,
+		Challenges: parseChallenges(resp.Header),
+	}
+	var foo struct {
+		Error string
+	}
+	if err := json.Unmarshal(body, &foo); err == nil {
+		e.Message = foo.Error
+	}
+	return e
 }
 
 // Get makes a HTTP GET request to the API.
-func (c *Client) Get(url string, dest any) error {
-	return c.Request("GET", url, []byte(nil), dest)
+func (c *Client) Get(url string, dest any, opts ...RequestOption) error {
+	return c.Request("GET", url, []byte(nil), dest, opts...)
+}
+
+// GetContext makes a HTTP GET request to the API using the provided context.
+func (c *Client) GetContext(ctx context.Context, url string, dest any, opts ...RequestOption) error {
+	return c.RequestContext(ctx, "GET", url, []byte(nil), dest, opts...)
 }
 
 // Post makes a HTTP POST request to the API.
-func (c *Client) Post(url string, data any, dest any) error {
-	return c.Request("POST", url, data, dest)
+func (c *Client) Post(url string, data any, dest any, opts ...RequestOption) error {
+	return c.Request("POST", url, data, dest, opts...)
+}
+
+// PostContext makes a HTTP POST request to the API using the provided context.
+func (c *Client) PostContext(ctx context.Context, url string, data any, dest any, opts ...RequestOption) error {
+	return c.RequestContext(ctx, "POST", url, data, dest, opts...)
 }
 
 // Put makes a HTTP PUT request to the API.
-func (c *Client) Put(url string, data any, dest any) error {
-	return c.Request("PUT", url, data, dest)
+func (c *Client) Put(url string, data any, dest any, opts ...RequestOption) error {
+	return c.Request("PUT", url, data, dest, opts...)
+}
+
+// PutContext makes a HTTP PUT request to the API using the provided context.
+func (c *Client) PutContext(ctx context.Context, url string, data any, dest any, opts ...RequestOption) error {
+	return c.RequestContext(ctx, "PUT", url, data, dest, opts...)
+}
+
+// Patch makes a HTTP PATCH request to the API.
+func (c *Client) Patch(url string, data any, dest any, opts ...RequestOption) error {
+	return c.Request("PATCH", url, data, dest, opts...)
+}
+
+// PatchContext makes a HTTP PATCH request to the API using the provided context.
+func (c *Client) PatchContext(ctx context.Context, url string, data any, dest any, opts ...RequestOption) error {
+	return c.RequestContext(ctx, "PATCH", url, data, dest, opts...)
 }
 
 // Delete makes a HTTP DELETE request to the API.
-func (c *Client) Delete(url string, dest any) error {
-	return c.Request("DELETE", url, []byte(nil), dest)
+func (c *Client) Delete(url string, dest any, opts ...RequestOption) error {
+	return c.Request("DELETE", url, []byte(nil), dest, opts...)
+}
+
+// DeleteContext makes a HTTP DELETE request to the API using the provided context.
+func (c *Client) DeleteContext(ctx context.Context, url string, dest any, opts ...RequestOption) error {
+	return c.RequestContext(ctx, "DELETE", url, []byte(nil), dest, opts...)
+}
+
+// Head makes a HTTP HEAD request to the API,
+// and returns the response status code and headers.
+func (c *Client) Head(url string, opts ...RequestOption) (*Response, error) {
+	return c.RequestFull("HEAD", url, []byte(nil), nil, opts...)
+}
+
+// HeadContext makes a HTTP HEAD request to the API using the provided context.
+func (c *Client) HeadContext(ctx context.Context, url string, opts ...RequestOption) (*Response, error) {
+	return c.RequestFullContext(ctx, "HEAD", url, []byte(nil), nil, opts...)
+}
+
+// Options makes a HTTP OPTIONS request to the API.
+// The response body, if not empty, is decoded into dest.
+func (c *Client) Options(url string, dest any, opts ...RequestOption) error {
+	_, err := c.RequestFull("OPTIONS", url, []byte(nil), dest, opts...)
+	return err
+}
+
+// OptionsContext makes a HTTP OPTIONS request to the API using the provided context.
+func (c *Client) OptionsContext(ctx context.Context, url string, dest any, opts ...RequestOption) error {
+	_, err := c.RequestFullContext(ctx, "OPTIONS", url, []byte(nil), dest, opts...)
+	return err
 }
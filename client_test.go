@@ -0,0 +1,946 @@
+package api
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestClientDecodeArray(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `[{"id":1},{"id":2},{"id":3}]`)
+	}))
+	defer ts.Close()
+
+	c := NewClient(ts.URL)
+	var ids []int
+	err := c.DecodeArray("GET", "/items", nil, func(decode func(any) error) error {
+		var item struct{ ID int }
+		if err := decode(&item); err != nil {
+			return err
+		}
+		ids = append(ids, item.ID)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("DecodeArray: %v", err)
+	}
+	if fmt.Sprint(ids) != "[1 2 3]" {
+		t.Errorf("DecodeArray: got ids %v, want [1 2 3]", ids)
+	}
+}
+
+func TestClientRequestContext(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	defer ts.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	err := NewClient(ts.URL).GetContext(ctx, "/slow", nil)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("GetContext: got error %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+func TestClientRequestContextBody(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "[1,")
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	}))
+	defer ts.Close()
+
+	for _, dest := range []any{new([]int), new([]byte)} {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		err := NewClient(ts.URL).GetContext(ctx, "/slow", dest)
+		cancel()
+		if err != context.DeadlineExceeded {
+			t.Errorf("GetContext into %T: got error %v, want %v", dest, err, context.DeadlineExceeded)
+		}
+	}
+}
+
+func TestClientRequestOptions(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "[%q,%q]", r.Header.Get("X-Foo"), r.Header.Get("Authorization"))
+	}))
+	defer ts.Close()
+
+	c := NewClient(ts.URL).WithToken("abc").WithHeader("Authorization", "ignored")
+	var got []string
+	if err := c.Get("/", &got, Header("X-Foo", "bar"), Token("xyz")); err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if got[0] != "bar" || got[1] != "Bearer xyz" {
+		t.Errorf("Get with options: got headers %q", got)
+	}
+	if err := c.Get("/", &got); err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if got[0] != "" || got[1] != "Bearer abc" {
+		t.Errorf("Get without options: got headers %q", got)
+	}
+	if err := c.WithHeader("X-Foo", "baz").Get("/", &got); err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if got[0] != "baz" {
+		t.Errorf("Get with WithHeader: got headers %q", got)
+	}
+}
+
+func TestClientUnixURL(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "api.sock")
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%q", r.URL.Path)
+	}))
+	ts.Listener = l
+	ts.Start()
+	defer ts.Close()
+
+	tests := []struct {
+		endPoint string
+		want     string
+	}{
+		{"unix://" + socket, "/status"},
+		{"http+unix://" + socket + ":/v1", "/v1/status"},
+		{"http+unix://" + url.PathEscape(socket) + "/v1", "/v1/status"},
+	}
+	for _, test := range tests {
+		var got string
+		if err := NewClient(test.endPoint).Get("/status", &got); err != nil {
+			t.Errorf("%s: %v", test.endPoint, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("%s: got path %q, want %q", test.endPoint, got, test.want)
+		}
+	}
+}
+
+func TestClientRetry(t *testing.T) {
+	var calls int
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if calls < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprint(w, "{}")
+	}))
+	defer ts.Close()
+
+	c := NewClient(ts.URL).WithRetry(3, time.Millisecond)
+	if err := c.Get("/", nil); err != nil {
+		t.Errorf("Get: %v", err)
+	}
+	if calls != 3 {
+		t.Errorf("Get: server called %d times, want 3", calls)
+	}
+
+	calls = 0
+	err := c.Post("/", nil, nil)
+	if err == nil {
+		t.Errorf("Post: expected an error")
+	}
+	if calls != 1 {
+		t.Errorf("Post: server called %d times, want 1", calls)
+	}
+
+	calls = 0
+	if err := c.Get("/", nil, NoRetry()); err == nil || calls != 1 {
+		t.Errorf("Get with NoRetry: got error %v after %d calls, want an error after 1 call", err, calls)
+	}
+
+	calls = -10
+	var re *RetryError
+	err = c.Get("/", nil)
+	if !errors.As(err, &re) || re.Attempts != 4 {
+		t.Errorf("Get: got error %v, want a *RetryError after 4 attempts", err)
+	}
+
+	for _, start := range []int{0, 2} {
+		calls = start
+		resp, err := c.RequestFull("GET", "/", nil, nil)
+		if want := 3 - start; err != nil || resp.Attempts != want {
+			t.Errorf("RequestFull: got %d attempts (error %v), want %d", resp.Attempts, err, want)
+		}
+	}
+}
+
+func TestClientRequestFull(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Link", `</items?page=2>; rel="next"`)
+		if r.URL.Path == "/missing" {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"error": "not found"}`)
+			return
+		}
+		fmt.Fprint(w, `[1,2,3]`)
+	}))
+	defer ts.Close()
+
+	c := NewClient(ts.URL)
+	var items []int
+	resp, err := c.RequestFull("GET", "/items", nil, &items)
+	if err != nil {
+		t.Fatalf("RequestFull: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Link") == "" || len(items) != 3 {
+		t.Errorf("RequestFull: got status %d, Link %q, items %v", resp.StatusCode, resp.Header.Get("Link"), items)
+	}
+	if string(resp.Bytes()) != "[1,2,3]" {
+		t.Errorf("RequestFull: got body %q", resp.Bytes())
+	}
+	if raw := resp.Raw(); raw == nil || raw.Request.URL.Path != "/items" {
+		t.Errorf("Raw: got %v", raw)
+	} else if b, _ := io.ReadAll(raw.Body); string(b) != "[1,2,3]" {
+		t.Errorf("Raw: got body %q", b)
+	}
+
+	resp, err = c.RequestFull("GET", "/missing", nil, nil)
+	if err == nil || resp == nil || resp.StatusCode != http.StatusNotFound {
+		t.Errorf("RequestFull: got response %v and error %v, want 404 and an error", resp, err)
+	}
+}
+
+func TestClientPatch(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%q", r.Method)
+	}))
+	defer ts.Close()
+
+	var method string
+	if err := NewClient(ts.URL).Patch("/item", map[string]int{"a": 1}, &method); err != nil {
+		t.Fatalf("Patch: %v", err)
+	}
+	if method != "PATCH" {
+		t.Errorf("Patch: server got method %q", method)
+	}
+}
+
+func TestClientHeadOptions(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Method", r.Method)
+		if r.Method == "OPTIONS" {
+			w.Header().Set("Allow", "GET, HEAD, OPTIONS")
+		}
+	}))
+	defer ts.Close()
+
+	c := NewClient(ts.URL)
+	resp, err := c.Head("/")
+	if err != nil {
+		t.Fatalf("Head: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("X-Method") != "HEAD" {
+		t.Errorf("Head: got status %d, headers %v", resp.StatusCode, resp.Header)
+	}
+	if err := c.Options("/", nil); err != nil {
+		t.Errorf("Options: %v", err)
+	}
+}
+
+func TestClientWithEscapeHTML(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		json.NewEncoder(w).Encode(string(b))
+	}))
+	defer ts.Close()
+
+	var got string
+	if err := NewClient(ts.URL).WithEscapeHTML(false).Post("/", "<b>", &got); err != nil {
+		t.Fatalf("Post: %v", err)
+	}
+	if want := `"<b>"`; got != want {
+		t.Errorf("Post: server got body %q, want %q", got, want)
+	}
+}
+
+func TestClientBasicAuth(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, pass, ok := r.BasicAuth()
+		json.NewEncoder(w).Encode([]any{user, pass, ok})
+	}))
+	defer ts.Close()
+
+	var got []any
+	if err := NewClient(ts.URL).WithToken("tk").WithBasicAuth("joe", "s3cr3t").Get("/", &got); err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if fmt.Sprint(got) != "[joe s3cr3t true]" {
+		t.Errorf("Get: server got basic auth %v", got)
+	}
+}
+
+func TestClientGetReader(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/bad" {
+			w.WriteHeader(http.StatusBadRequest)
+		}
+		fmt.Fprint(w, "raw data")
+	}))
+	defer ts.Close()
+
+	c := NewClient(ts.URL)
+	body, resp, err := c.GetReader("/ok")
+	if err != nil {
+		t.Fatalf("GetReader: %v", err)
+	}
+	b, _ := io.ReadAll(body)
+	body.Close()
+	if string(b) != "raw data" || resp.StatusCode != http.StatusOK {
+		t.Errorf("GetReader: got status %d and body %q", resp.StatusCode, b)
+	}
+
+	if _, _, err := c.GetReader("/bad"); err == nil {
+		t.Errorf("GetReader: expected an error for status 400")
+	}
+	body, resp, err = c.GetReader("/bad", AllowErrorStatus())
+	if err != nil {
+		t.Fatalf("GetReader with AllowErrorStatus: %v", err)
+	}
+	body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("GetReader with AllowErrorStatus: got status %d", resp.StatusCode)
+	}
+}
+
+func TestClientPostMultipart(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseMultipartForm(1 << 20); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		f, fh, err := r.FormFile("doc")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		b, _ := io.ReadAll(f)
+		json.NewEncoder(w).Encode([]string{r.FormValue("title"), fh.Filename, string(b)})
+	}))
+	defer ts.Close()
+
+	var got []string
+	err := NewClient(ts.URL).PostMultipart("/upload",
+		map[string]string{"title": "report"},
+		map[string]io.Reader{"doc": strings.NewReader("file contents")},
+		&got)
+	if err != nil {
+		t.Fatalf("PostMultipart: %v", err)
+	}
+	if fmt.Sprint(got) != "[report doc file contents]" {
+		t.Errorf("PostMultipart: server got %q", got)
+	}
+}
+
+func TestClientWithDecompression(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Encoding", "deflate")
+		fw, _ := flate.NewWriter(w, flate.BestSpeed)
+		fmt.Fprintf(fw, "%q", r.Header.Get("Accept-Encoding"))
+		fw.Close()
+	}))
+	defer ts.Close()
+
+	var got string
+	if err := NewClient(ts.URL).WithDecompression("deflate").Get("/", &got); err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if got != "deflate" {
+		t.Errorf("Get: server got Accept-Encoding %q", got)
+	}
+
+	encodings := []string{"br", "deflate"}
+	c := NewClient(ts.URL).WithDecompression(encodings...)
+	encodings[1] = "zstd"
+	if err := c.Get("/", &got); err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if got != "deflate" {
+		t.Errorf("Get with an unregistered encoding: server got Accept-Encoding %q, want %q", got, "deflate")
+	}
+}
+
+func TestClientContentType(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%q", r.Header.Get("Content-Type"))
+	}))
+	defer ts.Close()
+
+	c := NewClient(ts.URL)
+	tests := []struct {
+		c    *Client
+		data any
+		want string
+	}{
+		{c, map[string]int{"a": 1}, "application/json"},
+		{c, []byte("raw"), ""},
+		{c.WithContentType("text/plain"), []byte("raw"), "text/plain"},
+		{c.WithContentType("application/merge-patch+json"), map[string]int{"a": 1}, "application/merge-patch+json"},
+	}
+	for _, test := range tests {
+		var got string
+		if err := test.c.Post("/", test.data, &got); err != nil {
+			t.Fatalf("Post: %v", err)
+		}
+		if got != test.want {
+			t.Errorf("Post(%T): got Content-Type %q, want %q", test.data, got, test.want)
+		}
+	}
+}
+
+func TestClientGzip(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		zr, err := gzip.NewReader(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		body, _ := io.ReadAll(zr)
+		w.Header().Set("Content-Encoding", "gzip")
+		zw := gzip.NewWriter(w)
+		zw.Write(body)
+		zw.Close()
+	}))
+	defer ts.Close()
+
+	// setting Accept-Encoding disables the transparent decompression in net/http
+	c := NewClient(ts.URL).WithGzip().WithHeader("Accept-Encoding", "gzip")
+	var got []byte
+	if err := c.Post("/", []byte("hello"), &got); err != nil {
+		t.Fatalf("Post: %v", err)
+	}
+	if string(got) != "hello" {
+		t.Errorf("Post: got %q, want %q", got, "hello")
+	}
+}
+
+func TestClientAPIError(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		fmt.Fprint(w, `{"message": "invalid", "errors": ["name"]}`)
+	}))
+	defer ts.Close()
+
+	err := NewClient(ts.URL).Get("/", nil)
+	var ae *APIError
+	if !errors.As(err, &ae) {
+		t.Fatalf("Get: got error %v, want an *APIError", err)
+	}
+	if ae.StatusCode != http.StatusUnprocessableEntity || !strings.Contains(string(ae.Body), `"errors"`) {
+		t.Errorf("Get: got %+v", ae)
+	}
+	if got, want := err.Error(), "422 Unprocessable Entity"; got != want {
+		t.Errorf("Get: got error %q, want %q", got, want)
+	}
+}
+
+func TestClientAPIErrorExtraFields(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, `{"error": "boom", "request_id": "abc"}`)
+	}))
+	defer ts.Close()
+
+	err := NewClient(ts.URL).Get("/", nil)
+	var ae *APIError
+	if !errors.As(err, &ae) || ae.Message != "boom" {
+		t.Fatalf("Get: got error %v, want an *APIError with message %q", err, "boom")
+	}
+	if got, want := err.Error(), "400 Bad Request: boom"; got != want {
+		t.Errorf("Get: got error %q, want %q", got, want)
+	}
+}
+
+func TestParseClient(t *testing.T) {
+	for _, endPoint := range []string{"", "example.com/api", "http://[::1", "/api"} {
+		if _, err := ParseClient(endPoint); err == nil {
+			t.Errorf("ParseClient(%q): expected an error", endPoint)
+		}
+	}
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%q", r.URL.RequestURI())
+	}))
+	defer ts.Close()
+
+	c, err := ParseClient(ts.URL + "/v1?key=k")
+	if err != nil {
+		t.Fatalf("ParseClient: %v", err)
+	}
+	var got string
+	if err := c.Get("/items?page=2", &got); err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if want := "/v1/items?key=k&page=2"; got != want {
+		t.Errorf("Get: server got %q, want %q", got, want)
+	}
+}
+
+func TestClientWSJSON(t *testing.T) {
+	ts := httptest.NewServer(HandlerWS(func(r *Request, conn *Conn) {
+		var msg map[string]any
+		for conn.ReceiveJSON(&msg) == nil {
+			msg["auth"] = r.Header.Get("Authorization")
+			conn.SendJSON(msg)
+		}
+	}, nil))
+	defer ts.Close()
+
+	conn, err := NewClient(ts.URL).WithToken("tk").WS("/ws")
+	if err != nil {
+		t.Fatalf("WS: %v", err)
+	}
+	defer conn.Close()
+	if err := conn.SendJSON(map[string]any{"n": 1}); err != nil {
+		t.Fatalf("SendJSON: %v", err)
+	}
+	var got map[string]any
+	if err := conn.ReceiveJSON(&got); err != nil {
+		t.Fatalf("ReceiveJSON: %v", err)
+	}
+	if got["n"] != 1.0 || got["auth"] != "Bearer tk" {
+		t.Errorf("ReceiveJSON: got %v", got)
+	}
+
+	strict, err := NewClient(ts.URL).DisallowUnknownFields().WS("/ws")
+	if err != nil {
+		t.Fatalf("WS: %v", err)
+	}
+	defer strict.Close()
+	strict.SendJSON(map[string]any{"n": 1})
+	var n struct{ N int }
+	if err := strict.ReceiveJSON(&n); err == nil {
+		t.Errorf("ReceiveJSON with DisallowUnknownFields accepted an unknown field: %+v", n)
+	}
+}
+
+type testPositive struct {
+	N int
+}
+
+func (p testPositive) Validate() error {
+	if p.N <= 0 {
+		return errors.New("N must be positive")
+	}
+	return nil
+}
+
+func TestClientValidateResponses(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"N": -1}`)
+	}))
+	defer ts.Close()
+
+	var p testPositive
+	if err := NewClient(ts.URL).Get("/", &p); err != nil {
+		t.Errorf("Get without ValidateResponses: %v", err)
+	}
+	if err := NewClient(ts.URL).ValidateResponses().Get("/", &p); err == nil {
+		t.Errorf("Get with ValidateResponses: expected an error")
+	}
+}
+
+func TestClientGetStruct(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%q", r.URL.RawQuery)
+	}))
+	defer ts.Close()
+
+	type params struct {
+		Page  int      `query:"page,omitempty"`
+		Tags  []string `query:"tag"`
+		Draft bool     `query:"draft"`
+		Other string
+	}
+	var got string
+	err := NewClient(ts.URL).GetStruct("/items?sort=name", params{Tags: []string{"a", "b"}, Other: "x"}, &got)
+	if err != nil {
+		t.Fatalf("GetStruct: %v", err)
+	}
+	if want := "sort=name&draft=false&tag=a&tag=b"; got != want {
+		t.Errorf("GetStruct: server got query %q, want %q", got, want)
+	}
+}
+
+func TestClientClone(t *testing.T) {
+	hc := &http.Client{}
+	c := NewClient("http://example.com/v1").WithHeader("X-A", "1").WithHTTPClient(hc)
+	c2 := c.Clone()
+	c2.header.Add("X-A", "2")
+	c2.base.Path = "/v2"
+	if got := c.header.Values("X-A"); len(got) != 1 {
+		t.Errorf("modifying the clone changed the header of the original: %v", got)
+	}
+	if c.base.Path != "/v1" {
+		t.Errorf("modifying the clone changed the base of the original: %q", c.base.Path)
+	}
+	if c2.client != hc {
+		t.Errorf("the clone does not share the http.Client")
+	}
+}
+
+func TestClientMultipartBuilder(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseMultipartForm(1 << 20); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		_, fh, err := r.FormFile("image")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		json.NewEncoder(w).Encode([]string{r.FormValue("title"), fh.Filename, fh.Header.Get("Content-Type")})
+	}))
+	defer ts.Close()
+
+	b := NewMultipartBuilder().
+		AddField("title", "logo").
+		AddFile("image", "logo.png", "image/png", strings.NewReader("\x89PNG"))
+	if !strings.HasSuffix(b.ContentType(), b.Boundary()) {
+		t.Errorf("ContentType() = %q does not include the boundary %q", b.ContentType(), b.Boundary())
+	}
+	var got []string
+	err := NewClient(ts.URL).Post("/upload", b.Reader(), &got, Header("Content-Type", b.ContentType()))
+	if err != nil {
+		t.Fatalf("Post: %v", err)
+	}
+	if fmt.Sprint(got) != "[logo logo.png image/png]" {
+		t.Errorf("server got %q", got)
+	}
+}
+
+func TestClientWSReceiveContext(t *testing.T) {
+	ts := httptest.NewServer(HandlerWS(func(r *Request, conn *Conn) {
+		var msg any
+		conn.ReceiveJSON(&msg)
+	}, nil))
+	defer ts.Close()
+
+	conn, err := NewClient(ts.URL).WS("/ws")
+	if err != nil {
+		t.Fatalf("WS: %v", err)
+	}
+	defer conn.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	var msg any
+	if err := conn.ReceiveContext(ctx, &msg); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("ReceiveContext: got %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	conn.SetWriteDeadline(time.Now().Add(-time.Second))
+	if err := conn.SendJSON(1); err == nil {
+		t.Errorf("SendJSON after the write deadline did not fail")
+	}
+}
+
+func TestClientWithMarshaler(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(w, r.Body)
+	}))
+	defer ts.Close()
+
+	var marshaled, unmarshaled int
+	c := NewClient(ts.URL).WithMarshaler(
+		func(v any) ([]byte, error) {
+			marshaled++
+			return json.Marshal(v)
+		},
+		func(b []byte, v any) error {
+			unmarshaled++
+			return json.Unmarshal(b, v)
+		})
+	var got map[string]int
+	if err := c.Post("/echo", map[string]int{"n": 1}, &got); err != nil {
+		t.Fatalf("Post: %v", err)
+	}
+	if got["n"] != 1 || marshaled != 1 || unmarshaled != 1 {
+		t.Errorf("got %v, marshal called %d times, unmarshal called %d times", got, marshaled, unmarshaled)
+	}
+}
+
+func TestClientAPIErrorChallenges(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("WWW-Authenticate", `Bearer realm="https://auth.example.com/token", scope="repo:read", error="invalid_token"`)
+		w.Header().Add("WWW-Authenticate", `Basic realm="a \"quoted\" realm", Negotiate abc123==`)
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer ts.Close()
+
+	err := NewClient(ts.URL).Get("/private", nil)
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) {
+		t.Fatalf("got %v, want an *APIError", err)
+	}
+	want := []Challenge{
+		{Scheme: "Bearer", Params: map[string]string{
+			"realm": "https://auth.example.com/token", "scope": "repo:read", "error": "invalid_token"}},
+		{Scheme: "Basic", Params: map[string]string{"realm": `a "quoted" realm`}},
+		{Scheme: "Negotiate", Token68: "abc123=="},
+	}
+	if fmt.Sprint(apiErr.Challenges) != fmt.Sprint(want) {
+		t.Errorf("got %+v, want %+v", apiErr.Challenges, want)
+	}
+	if apiErr.Challenges[0].Realm() != "https://auth.example.com/token" {
+		t.Errorf("Realm() = %q", apiErr.Challenges[0].Realm())
+	}
+}
+
+func TestClientURL(t *testing.T) {
+	c := NewClient("https://api.example.com/v1?lang=en").WithParamToken("token").WithToken("secret")
+	u, err := c.URL("/items?sort=name", url.Values{"page": {"2"}})
+	if err != nil {
+		t.Fatalf("URL: %v", err)
+	}
+	if want := "https://api.example.com/v1/items?lang=en&sort=name&page=2"; u.String() != want {
+		t.Errorf("got %q, want %q", u, want)
+	}
+	if _, err := NewClient("invalid").URL("/items", nil); err == nil {
+		t.Errorf("URL with an invalid end point did not fail")
+	}
+}
+
+func TestClientRequestTimeout(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(50 * time.Millisecond):
+			w.Write([]byte(`"done"`))
+		case <-r.Context().Done():
+		}
+	}))
+	defer ts.Close()
+
+	c := NewClient(ts.URL).WithTimeout(10 * time.Millisecond)
+	if err := c.Get("/report", nil); err == nil {
+		t.Errorf("Get: expected a timeout error")
+	}
+	var s string
+	if err := c.Get("/report", &s, Timeout(time.Second)); err != nil || s != "done" {
+		t.Errorf("Get with Timeout: got %q, %v", s, err)
+	}
+	err := NewClient(ts.URL).Get("/report", nil, Timeout(10*time.Millisecond))
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Get with short Timeout: got error %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+func TestClientResponseCookies(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.SetCookie(w, &http.Cookie{Name: "session", Value: "abc123"})
+		fmt.Fprint(w, `"welcome"`)
+	}))
+	defer ts.Close()
+
+	resp, err := NewClient(ts.URL).RequestFull("POST", "/login", nil, nil)
+	if err != nil {
+		t.Fatalf("RequestFull: %v", err)
+	}
+	if cookies := resp.Cookies(); len(cookies) != 1 || cookies[0].Name != "session" || cookies[0].Value != "abc123" {
+		t.Errorf("Cookies: got %v", cookies)
+	}
+}
+
+func TestClientStream(t *testing.T) {
+	const size = 1 << 20
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.CopyN(w, zeroReader{}, size)
+	}))
+	defer ts.Close()
+
+	body, resp, err := NewClient(ts.URL).Stream("GET", "/download", []byte(nil))
+	if err != nil {
+		t.Fatalf("Stream: %v", err)
+	}
+	defer body.Close()
+	n, err := io.Copy(io.Discard, body)
+	if err != nil || n != size || resp.Bytes() != nil {
+		t.Errorf("Stream: read %d bytes (error %v), buffered %d", n, err, len(resp.Bytes()))
+	}
+}
+
+type zeroReader struct{}
+
+func (zeroReader) Read(b []byte) (int, error) {
+	clear(b)
+	return len(b), nil
+}
+
+func TestClientHooks(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%q", r.Header.Get("X-Trace"))
+	}))
+	defer ts.Close()
+
+	var status int
+	var elapsed time.Duration
+	c := NewClient(ts.URL).WithRequestHook(func(r *http.Request) {
+		r.Header.Set("X-Trace", r.Method+" "+r.URL.Path)
+	}).WithResponseHook(func(resp *http.Response, d time.Duration) {
+		status, elapsed = resp.StatusCode, d
+	})
+	var s string
+	if err := c.Get("/items", &s); err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if s != "GET /items" || status != http.StatusOK || elapsed <= 0 {
+		t.Errorf("got %q, status %d and elapsed time %v", s, status, elapsed)
+	}
+}
+
+func TestClientWithVerbose(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Reply", "pong")
+		fmt.Fprint(w, "{}")
+	}))
+	defer ts.Close()
+
+	var buf bytes.Buffer
+	c := NewClient(ts.URL).WithVerbose(&buf).WithHeader("X-Ping", "ping")
+	if err := c.Get("/ping", nil); err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	for _, want := range []string{"> GET " + ts.URL + "/ping\n", "> X-Ping: ping\n", "< HTTP/1.1 200 OK\n", "< X-Reply: pong\n"} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("WithVerbose: output %q does not contain %q", buf.String(), want)
+		}
+	}
+
+	for _, c := range []*Client{
+		NewClient(ts.URL).WithToken("s3cret"),
+		NewClient(ts.URL).WithToken("s3cret").WithHeaderToken("X-API-Key"),
+		NewClient(ts.URL).WithToken("s3cret").WithParamToken("private_token"),
+		NewClient(ts.URL).WithBasicAuth("user", "s3cret"),
+	} {
+		buf.Reset()
+		if err := c.WithVerbose(&buf).Get("/ping", nil); err != nil {
+			t.Fatalf("Get: %v", err)
+		}
+		if strings.Contains(buf.String(), "s3cret") || strings.Contains(buf.String(), base64.StdEncoding.EncodeToString([]byte("user:s3cret"))) {
+			t.Errorf("WithVerbose: output %q contains the credentials", buf.String())
+		}
+	}
+}
+
+func TestClientRawMessage(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		json.NewEncoder(w).Encode(r.Header.Get("Content-Type") + " " + string(body))
+	}))
+	defer ts.Close()
+
+	var s string
+	err := NewClient(ts.URL).Post("/items", json.RawMessage(`{"name": "x"}`), &s)
+	if err != nil {
+		t.Fatalf("Post: %v", err)
+	}
+	if want := `application/json {"name": "x"}`; s != want {
+		t.Errorf("Post: server got %q, want %q", s, want)
+	}
+}
+
+func TestClientByStatus(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/pending" {
+			w.WriteHeader(http.StatusAccepted)
+			fmt.Fprint(w, `{"eta": 5}`)
+			return
+		}
+		fmt.Fprint(w, `{"id": 42}`)
+	}))
+	defer ts.Close()
+
+	c := NewClient(ts.URL)
+	for _, path := range []string{"/done", "/pending"} {
+		var job struct{ ID int }
+		var pending struct{ ETA int }
+		if err := c.Get(path, ByStatus{200: &job, 202: &pending}); err != nil {
+			t.Fatalf("Get %s: %v", path, err)
+		}
+		if path == "/done" && (job.ID != 42 || pending.ETA != 0) || path == "/pending" && (job.ID != 0 || pending.ETA != 5) {
+			t.Errorf("Get %s: got job %+v and pending %+v", path, job, pending)
+		}
+	}
+}
+
+func TestClientWithAcceptEncoding(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Encoding", "gzip")
+		zw := gzip.NewWriter(w)
+		fmt.Fprintf(zw, "%q", r.Header.Get("Accept-Encoding"))
+		zw.Close()
+	}))
+	defer ts.Close()
+
+	var got string
+	c := NewClient(ts.URL).WithHeader("Accept-Encoding", "identity").WithAcceptEncoding("gzip")
+	if err := c.Get("/", &got); err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if got != "gzip" {
+		t.Errorf("Get: server got Accept-Encoding %q, want %q", got, "gzip")
+	}
+}
+
+func TestClientDialTimeoutReusesConnections(t *testing.T) {
+	var conns atomic.Int32
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "{}")
+	}))
+	ts.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			conns.Add(1)
+		}
+	}
+	ts.Start()
+	defer ts.Close()
+
+	c := NewClient(ts.URL).WithDialTimeout(time.Second)
+	for i := 0; i < 20; i++ {
+		if err := c.Get("/", nil); err != nil {
+			t.Fatalf("Get: %v", err)
+		}
+	}
+	if n := conns.Load(); n != 1 {
+		t.Errorf("20 requests opened %d connections, want 1", n)
+	}
+}
+
+func TestClientNoContent(t *testing.T) {
+	s := NewServer()
+	s.Handle("DELETE /items/{id}", func(*Request) error { return nil })
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	var dest map[string]any
+	c := NewClient(ts.URL)
+	if err := c.Delete("/items/1", nil); err != nil {
+		t.Errorf("Delete: %v", err)
+	}
+	if err := c.Request("DELETE", "/items/1", nil, &dest); err != nil || dest != nil {
+		t.Errorf("Request: got %v, %v", dest, err)
+	}
+}
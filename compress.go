@@ -0,0 +1,141 @@
+package api
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// A Decompressor returns a reader which decompresses the data read from r.
+type Decompressor func(r io.Reader) (io.ReadCloser, error)
+
+var (
+	decompressorsMu sync.RWMutex
+	decompressors   = map[string]Decompressor{
+		"gzip": func(r io.Reader) (io.ReadCloser, error) {
+			return gzip.NewReader(r)
+		},
+		"deflate": func(r io.Reader) (io.ReadCloser, error) {
+			return flate.NewReader(r), nil
+		},
+	}
+)
+
+// RegisterDecompressor makes a decompressor available for a content encoding,
+// both for the responses received by a Client (see Client.WithDecompression)
+// and for the requests received by a Server.
+// "gzip" and "deflate" are available by default; other encodings such as
+// "br" or "zstd" need an external library, for example:
+//
+//	api.RegisterDecompressor("zstd", func(r io.Reader) (io.ReadCloser, error) {
+//		d, err := zstd.NewReader(r)
+//		if err != nil {
+//			return nil, err
+//		}
+//		return d.IOReadCloser(), nil
+//	})
+func RegisterDecompressor(encoding string, d Decompressor) {
+	decompressorsMu.Lock()
+	defer decompressorsMu.Unlock()
+	decompressors[strings.ToLower(encoding)] = d
+}
+
+// getDecompressor returns the decompressor registered for an encoding, or nil.
+func getDecompressor(encoding string) Decompressor {
+	decompressorsMu.RLock()
+	defer decompressorsMu.RUnlock()
+	return decompressors[strings.ToLower(encoding)]
+}
+
+// requestBody returns the body of r, decompressed according to its Content-Encoding.
+// The returned error has a suitable HTTP status code.
+func requestBody(r *http.Request) (io.ReadCloser, error) {
+	ce := strings.TrimSpace(r.Header.Get("Content-Encoding"))
+	if ce == "" || strings.EqualFold(ce, "identity") {
+		return r.Body, nil
+	}
+	d := getDecompressor(ce)
+	if d == nil {
+		return nil, HTTPError(http.StatusUnsupportedMediaType, "unsupported content encoding %q", ce)
+	}
+	body, err := d(r.Body)
+	if err != nil {
+		return nil, HTTPError(http.StatusBadRequest, "decompressing body: %w", err)
+	}
+	return body, nil
+}
+
+// decompressedBody is the body of a decompressed response.
+type decompressedBody struct {
+	io.ReadCloser           // the decompressor
+	body          io.Closer // the original body
+}
+
+func (b decompressedBody) Close() error {
+	b.ReadCloser.Close()
+	return b.body.Close()
+}
+
+// decompressResponse replaces the body of resp with its decompressed content,
+// if its Content-Encoding is gzip or one of encodings.
+func decompressResponse(resp *http.Response, encodings []string) error {
+	ce := strings.TrimSpace(resp.Header.Get("Content-Encoding"))
+	if ce == "" || (!strings.EqualFold(ce, "gzip") && !containsFold(encodings, ce)) {
+		return nil
+	}
+	d := getDecompressor(ce)
+	if d == nil {
+		return fmt.Errorf("api: no decompressor registered for %q", ce)
+	}
+	r, err := d(resp.Body)
+	if err != nil {
+		return fmt.Errorf("api: decompressing response: %w", err)
+	}
+	resp.Body = decompressedBody{ReadCloser: r, body: resp.Body}
+	resp.Header.Del("Content-Encoding")
+	resp.Header.Del("Content-Length")
+	resp.ContentLength = -1
+	resp.Uncompressed = true
+	return nil
+}
+
+func containsFold(list []string, s string) bool {
+	for _, l := range list {
+		if strings.EqualFold(l, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// gzipBytes returns the gzip-compressed content of b.
+func gzipBytes(b []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(b); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// gzipReader returns a reader with the gzip-compressed content read from r.
+func gzipReader(r io.Reader) io.Reader {
+	pr, pw := io.Pipe()
+	go func() {
+		zw := gzip.NewWriter(pw)
+		_, err := io.Copy(zw, r)
+		if err == nil {
+			err = zw.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+	return pr
+}
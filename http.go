@@ -1,34 +1,65 @@
 package api
 
 import (
+	"bytes"
+	"context"
 	"database/sql"
-	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"log"
+	"net"
 	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
 )
 
 // Exported functions:
 //   - func HTTPError(code int, f any, a ...any) error
+//   - func HTTPErrorWithHeaders(code int, h http.Header, msg string) error
+//   - func HTTPErrorDetail(code int, payload any) error
+//   - func RegisterErrorStatus(target error, code int)
+//   - func FormErrorEncoder(w http.ResponseWriter, code int, msg string)
+//   - func Output(w http.ResponseWriter, output any)
 
 // Exported types:
 //   - type HTTPStatus interface { ... }
 
+// Exported constants:
+//   - RequestIDKey
+
 // These functions are used by other files in this package:
 //   - httpError()
 //   - httpCodeError()
+//   - outputRequest()
 
 // Dependencies:
-//   - HTTPError     -> errHTTPStatus
-//   - HTTPStatus    -> (none)
-//   - httpError     -> httpMessage
-//   - httpCodeError -> HTTPError, httpError
-//   - apiError      -> errHTTPStatus, HTTPError
-//   - httpMessage   -> (none)
+//   - HTTPError            -> errHTTPStatus
+//   - HTTPErrorWithHeaders -> errHTTPStatus
+//   - HTTPErrorDetail      -> errHTTPStatus
+//   - RegisterErrorStatus  -> (none)
+//   - HTTPStatus           -> (none)
+//   - FormErrorEncoder     -> (none)
+//   - Output               -> outputRequest
+//   - httpError            -> httpMessage, requestServer, jsonEncoder, errorStatus, sqlStateStatus, requestID
+//   - sqlStateStatus       -> (none)
+//   - requestID            -> Request.Get
+//   - httpCodeError        -> HTTPError, httpError
+//   - apiError             -> errHTTPStatus, HTTPError, errorStatus
+//   - errorStatus          -> (none)
+//   - httpMessage          -> requestServer, jsonEncoder
+//   - outputRequest        -> httpError, httpMessage, clientGone, requestServer, negotiate, encodeOutput
+//   - clientGone           -> (none)
 
 // Errors...:
 type errHTTPStatus struct {
 	Status int
+	Header http.Header // added to the response, if not nil
+	Detail any         // sent as the JSON body of the response, if not nil
 	Err    error
 }
 
@@ -44,6 +75,14 @@ func (e errHTTPStatus) HTTPStatus() int {
 	return e.Status
 }
 
+func (e errHTTPStatus) HTTPHeader() http.Header {
+	return e.Header
+}
+
+func (e errHTTPStatus) HTTPDetail() any {
+	return e.Detail
+}
+
 // Error returns an errHTTPStatus from another error or a printf-like string.
 // The default HTTP status code is BadRequest.
 func apiError(f any, a ...any) error {
@@ -65,10 +104,67 @@ func apiError(f any, a ...any) error {
 	case errors.Is(err, sql.ErrNoRows):
 		code = http.StatusNotFound
 		err = errors.New("not found")
+	default:
+		if c, ok := errorStatus(err); ok {
+			code = c
+		}
 	}
 	return HTTPError(code, err)
 }
 
+// errorStatusEntry is a status code registered with RegisterErrorStatus.
+type errorStatusEntry struct {
+	target error
+	code   int
+}
+
+var (
+	errorStatusesMu sync.RWMutex
+	errorStatuses   = []errorStatusEntry{
+		{context.DeadlineExceeded, http.StatusGatewayTimeout},
+		{context.Canceled, 499}, // Client Closed Request, as used by nginx
+		{os.ErrPermission, http.StatusForbidden},
+		{io.ErrUnexpectedEOF, http.StatusBadRequest},
+	}
+)
+
+// RegisterErrorStatus causes the errors matching target (see errors.Is)
+// returned by the handlers to be sent with the HTTP status code,
+// unless they implement HTTPStatus.  Registering a target again replaces its code.
+//
+// These are registered by default:
+//   - context.DeadlineExceeded: 504 Gateway Timeout
+//   - context.Canceled: 499 Client Closed Request
+//   - os.ErrPermission: 403 Forbidden
+//   - io.ErrUnexpectedEOF: 400 Bad Request
+//
+// sql.ErrNoRows is always sent as 404 Not Found.
+// Other errors are sent as 400 Bad Request.
+func RegisterErrorStatus(target error, code int) {
+	errorStatusesMu.Lock()
+	defer errorStatusesMu.Unlock()
+	for i := range errorStatuses {
+		if errorStatuses[i].target == target {
+			errorStatuses[i].code = code
+			return
+		}
+	}
+	errorStatuses = append(errorStatuses, errorStatusEntry{target, code})
+}
+
+// errorStatus returns the status code registered for err
+// with RegisterErrorStatus, if any.
+func errorStatus(err error) (int, bool) {
+	errorStatusesMu.RLock()
+	defer errorStatusesMu.RUnlock()
+	for _, es := range errorStatuses {
+		if errors.Is(err, es.target) {
+			return es.code, true
+		}
+	}
+	return 0, false
+}
+
 // HTTPError returns an error with an embedded HTTP status code
 func HTTPError(code int, f any, a ...any) error {
 	var err error
@@ -86,6 +182,36 @@ func HTTPError(code int, f any, a ...any) error {
 	}
 }
 
+// HTTPErrorWithHeaders returns an error with an embedded HTTP status code
+// and some headers to be added to the response, like
+// WWW-Authenticate in a 401 Unauthorized or Retry-After in a 429 Too Many Requests.
+func HTTPErrorWithHeaders(code int, h http.Header, msg string) error {
+	return errHTTPStatus{
+		Status: code,
+		Header: h,
+		Err:    errors.New(msg),
+	}
+}
+
+// HTTPErrorDetail returns an error with an embedded HTTP status code
+// and a payload which is sent as the JSON body of the response,
+// instead of the usual {"error": "message"}:
+//
+//	return nil, api.HTTPErrorDetail(http.StatusUnprocessableEntity, map[string]any{
+//		"error":  "validation",
+//		"fields": map[string]string{"email": "required"},
+//	})
+//
+// If the Server has an error encoder (see Server.SetErrorEncoder),
+// it is used instead, with the status text as the message.
+func HTTPErrorDetail(code int, payload any) error {
+	return errHTTPStatus{
+		Status: code,
+		Detail: payload,
+		Err:    errors.New(http.StatusText(code)),
+	}
+}
+
 type HTTPStatus interface {
 	HTTPStatus() int
 }
@@ -94,7 +220,13 @@ type HTTPStatus interface {
 //
 // If the error returned by the function implements HTTPStatus,
 // it is used as the HTTP Status code to be returned.
-func httpError(w http.ResponseWriter, f any, a ...any) {
+// Otherwise, the status code is taken from RegisterErrorStatus,
+// or from the SQLSTATE of database errors with a SQLState method
+// (eg, 409 Conflict for unique and foreign key violations).
+//
+// If r is being served by a Server with an error encoder,
+// it is used to write the response.
+func httpError(w http.ResponseWriter, r *http.Request, f any, a ...any) {
 	var err error
 	if e, ok := f.(error); ok {
 		err = e
@@ -110,6 +242,12 @@ func httpError(w http.ResponseWriter, f any, a ...any) {
 	}
 
 	var eh HTTPStatus
+	var ehh interface{ HTTPHeader() http.Header }
+	if errors.As(err, &ehh) {
+		for k, v := range ehh.HTTPHeader() {
+			w.Header()[k] = v
+		}
+	}
 
 	code := http.StatusBadRequest
 	switch {
@@ -118,47 +256,159 @@ func httpError(w http.ResponseWriter, f any, a ...any) {
 	case errors.Is(err, sql.ErrNoRows):
 		code = http.StatusNotFound
 		err = errors.New("not found")
+	default:
+		if c, ok := errorStatus(err); ok {
+			code = c
+		} else if es != nil {
+			code = sqlStateStatus(es.SQLState())
+		}
 	}
 
-	httpMessage(w, code, "error", err.Error())
+	s := requestServer(r)
+	if s != nil && s.errorEncoder != nil {
+		s.errorEncoder(w, code, err.Error())
+		return
+	}
+	var ed interface{ HTTPDetail() any }
+	if errors.As(err, &ed) && ed.HTTPDetail() != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(code)
+		s.jsonEncoder(w).Encode(ed.HTTPDetail())
+		return
+	}
+	if id := requestID(r); id != "" {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(code)
+		s.jsonEncoder(w).Encode(struct {
+			Error     string `json:"error"`
+			RequestID string `json:"request_id"`
+		}{err.Error(), id})
+		return
+	}
+	httpMessage(w, r, code, "error", err.Error())
+}
+
+// sqlStateStatuses are the HTTP status codes for the errors
+// with a SQLSTATE code (or class) beginning with every prefix.
+var sqlStateStatuses = []struct {
+	prefix string
+	code   int
+}{
+	{"23505", http.StatusConflict},   // unique_violation
+	{"23503", http.StatusConflict},   // foreign_key_violation
+	{"23502", http.StatusBadRequest}, // not_null_violation
+}
+
+// sqlStateStatus returns the HTTP status code for an error
+// with the given SQLSTATE code: 400 Bad Request by default.
+func sqlStateStatus(state string) int {
+	for _, s := range sqlStateStatuses {
+		if strings.HasPrefix(state, s.prefix) {
+			return s.code
+		}
+	}
+	return http.StatusBadRequest
+}
+
+// RequestIDKey is the key of the Request value (see Request.Set)
+// with the ID of the request, if any.  Middlewares which assign an ID
+// to every request should set it, so it is included as a "request_id" field
+// in the JSON error responses, and clients can report it.
+const RequestIDKey = "request_id"
+
+// requestID returns the ID of the request r, if it has been set
+// in its RequestIDKey value.
+func requestID(r *http.Request) string {
+	if r == nil {
+		return ""
+	}
+	id, _ := (&Request{r}).Get(RequestIDKey).(string)
+	return id
 }
 
 // httpCodeError sends a HTTP error as a response.
-func httpCodeError(w http.ResponseWriter, code int, f any, a ...any) {
+func httpCodeError(w http.ResponseWriter, r *http.Request, code int, f any, a ...any) {
 	err := HTTPError(code, f, a...).(errHTTPStatus)
-	httpError(w, err)
+	httpError(w, r, err)
 }
 
-func httpMessage(w http.ResponseWriter, code int, label string, msg string) {
+// FormErrorEncoder is an error encoder (see Server.SetErrorEncoder)
+// that sends the errors as "application/x-www-form-urlencoded" instead of JSON,
+// in the form "error=message&status=400".
+func FormErrorEncoder(w http.ResponseWriter, code int, msg string) {
+	v := url.Values{}
+	v.Set("error", msg)
+	v.Set("status", strconv.Itoa(code))
+	w.Header().Set("Content-Type", "application/x-www-form-urlencoded")
+	w.WriteHeader(code)
+	io.WriteString(w, v.Encode())
+}
+
+// httpMessage sends a JSON object like {"label": "msg"},
+// with the JSON options of the Server handling r, if any.
+func httpMessage(w http.ResponseWriter, r *http.Request, code int, label string, msg string) {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(code)
-	fmt.Fprintf(w, "{%q: %q}\n", label, msg)
+	requestServer(r).jsonEncoder(w).Encode(map[string]string{label: msg})
 }
 
 // Output sends a JSON-encoded output.
+//
+// Errors are sent using httpError, strings as {"info": "message"},
+// and []byte as they are, with the Content-Type detected
+// by http.DetectContentType if it has not been set.
 func Output(w http.ResponseWriter, output any) {
+	outputRequest(w, nil, output)
+}
+
+// outputRequest sends an output as a response to r,
+// encoded according to its Accept header (JSON by default).
+func outputRequest(w http.ResponseWriter, r *http.Request, output any) {
 	if err, ok := output.(error); ok {
-		httpError(w, err)
+		httpError(w, r, err)
 		return
 	}
 
 	// if the returned type is a string, output it as a "info" message:
 	if s, ok := output.(string); ok {
-		httpMessage(w, http.StatusOK, "info", s)
+		httpMessage(w, r, http.StatusOK, "info", s)
 		return
 	}
 
-	// if the returned type is a []byte, output it directly:
+	// if the returned type is a []byte, output it directly,
+	// detecting its content type if it has not been set:
 	if b, ok := output.([]byte); ok {
+		if w.Header().Get("Content-Type") == "" && len(b) > 0 {
+			w.Header().Set("Content-Type", http.DetectContentType(b))
+		}
 		w.Write(b)
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
+	mediaType := negotiate(r)
+	var buf bytes.Buffer
+	if err := encodeOutput(&buf, r, mediaType, output); err != nil {
+		code := http.StatusInternalServerError
+		if errors.Is(err, errNotAcceptable) {
+			code = http.StatusNotAcceptable
+		}
+		httpCodeError(w, r, code, err)
+		return
+	}
+	w.Header().Set("Content-Type", mediaType)
 	w.WriteHeader(http.StatusOK)
-	e := json.NewEncoder(w)
-	err := e.Encode(output)
-	if err != nil {
-		fmt.Fprintf(w, "{\"error\": %q}\n", err.Error())
+	if _, err := w.Write(buf.Bytes()); err != nil && clientGone(r, err) {
+		if s := requestServer(r); s != nil && s.debug {
+			log.Printf("api: client disconnected while sending response: %v", err)
+		}
+	}
+}
+
+// clientGone reports whether err is caused by the client
+// closing the connection or cancelling the request.
+func clientGone(r *http.Request, err error) bool {
+	if errors.Is(err, syscall.EPIPE) || errors.Is(err, syscall.ECONNRESET) || errors.Is(err, net.ErrClosed) {
+		return true
 	}
+	return r != nil && r.Context().Err() != nil
 }
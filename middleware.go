@@ -0,0 +1,369 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"net/http"
+	"net/http/httputil"
+	"runtime/debug"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RecoverMiddleware is a middleware that recovers from panics in the handlers,
+// logs them and sends a 500 Internal Server Error response.
+//
+// If the Server is in debug mode (see SetDebug), the response includes
+// the stack trace in a "trace" field.  Otherwise it is only logged.
+func (s *Server) RecoverMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			x := recover()
+			if x == nil {
+				return
+			}
+			if x == http.ErrAbortHandler {
+				panic(x)
+			}
+			trace := debug.Stack()
+			log.Printf("api: panic serving %s %s: %v\n%s", r.Method, r.URL, x, trace)
+			var resp struct {
+				Error string `json:"error"`
+				Trace string `json:"trace,omitempty"`
+			}
+			resp.Error = http.StatusText(http.StatusInternalServerError)
+			if s.debug {
+				resp.Error = fmt.Sprint(x)
+				resp.Trace = string(trace)
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusInternalServerError)
+			s.jsonEncoder(w).Encode(resp)
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// HTTPOnly wraps a middleware so it is bypassed for WebSocket requests
+// (see IsWebSocket), which are passed directly to the next handler.
+// It is useful for middlewares which would interfere with long-lived
+// connections, like compression or timeouts:
+//
+//	s.AddMiddleware(api.HTTPOnly(gzipMiddleware))
+func HTTPOnly(mw func(http.Handler) http.Handler) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		wrapped := mw(next)
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if IsWebSocket(r) {
+				next.ServeHTTP(w, r)
+				return
+			}
+			wrapped.ServeHTTP(w, r)
+		})
+	}
+}
+
+// CORSOptions configures the CORS middleware.
+type CORSOptions struct {
+	// AllowedOrigins is the list of origins allowed to make cross-origin requests.
+	// "*" allows any origin.
+	AllowedOrigins []string
+
+	// AllowedMethods is the list of methods allowed in cross-origin requests.
+	// The default is GET, HEAD, POST, PUT, PATCH and DELETE.
+	AllowedMethods []string
+
+	// AllowedHeaders is the list of request headers allowed in cross-origin requests.
+	// If empty, any header requested by the client is allowed.
+	AllowedHeaders []string
+
+	// ExposedHeaders is the list of response headers the browser can access.
+	ExposedHeaders []string
+
+	// AllowCredentials allows requests with cookies or HTTP authentication.
+	AllowCredentials bool
+
+	// MaxAge is how long the response to a preflight request can be cached.
+	MaxAge time.Duration
+}
+
+// CORS returns a middleware which adds the Access-Control-* headers
+// to the responses to cross-origin requests, as configured in opts.
+// Preflight requests (OPTIONS with Access-Control-Request-Method)
+// from an allowed origin get a 204 No Content response without calling
+// the next handler.  Requests from other origins are passed unmodified.
+//
+// It should be added before other middlewares, so preflight requests
+// do not need to go through them:
+//
+//	s.AddMiddleware(api.CORS(api.CORSOptions{AllowedOrigins: []string{"https://example.com"}}))
+func CORS(opts CORSOptions) func(http.Handler) http.Handler {
+	methods := opts.AllowedMethods
+	if len(methods) == 0 {
+		methods = []string{"GET", "HEAD", "POST", "PUT", "PATCH", "DELETE"}
+	}
+	anyOrigin := slices.Contains(opts.AllowedOrigins, "*")
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			origin := r.Header.Get("Origin")
+			if origin == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+			h := w.Header()
+			h.Add("Vary", "Origin")
+			if !anyOrigin && !slices.Contains(opts.AllowedOrigins, origin) {
+				next.ServeHTTP(w, r)
+				return
+			}
+			if anyOrigin && !opts.AllowCredentials {
+				h.Set("Access-Control-Allow-Origin", "*")
+			} else {
+				h.Set("Access-Control-Allow-Origin", origin)
+			}
+			if opts.AllowCredentials {
+				h.Set("Access-Control-Allow-Credentials", "true")
+			}
+			if r.Method == "OPTIONS" && r.Header.Get("Access-Control-Request-Method") != "" {
+				h.Add("Vary", "Access-Control-Request-Method")
+				h.Add("Vary", "Access-Control-Request-Headers")
+				h.Set("Access-Control-Allow-Methods", strings.Join(methods, ", "))
+				if len(opts.AllowedHeaders) > 0 {
+					h.Set("Access-Control-Allow-Headers", strings.Join(opts.AllowedHeaders, ", "))
+				} else if req := r.Header.Get("Access-Control-Request-Headers"); req != "" {
+					h.Set("Access-Control-Allow-Headers", req)
+				}
+				if opts.MaxAge > 0 {
+					h.Set("Access-Control-Max-Age", strconv.Itoa(int(opts.MaxAge.Seconds())))
+				}
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+			if len(opts.ExposedHeaders) > 0 {
+				h.Set("Access-Control-Expose-Headers", strings.Join(opts.ExposedHeaders, ", "))
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// RequireContentLength returns a middleware which rejects the requests
+// whose body length is unknown (because they have no Content-Length header,
+// like chunked uploads) with 411 Length Required.
+// GET and HEAD requests are always accepted.
+//
+// It can be used for all the routes with Server.AddMiddleware,
+// or for some of them with WithMiddleware:
+//
+//	s.HandleWith("POST /ingest", ingest, api.WithMiddleware(api.RequireContentLength()))
+func RequireContentLength() func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.ContentLength < 0 && r.Method != "GET" && r.Method != "HEAD" {
+				httpCodeError(w, r, http.StatusLengthRequired, "Content-Length required")
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// dumpMaxBody is the maximum number of bytes of every body written by DumpMiddleware.
+const dumpMaxBody = 64 << 10
+
+// DumpMiddleware returns a middleware which writes every request
+// (request line, headers and body) and its response (status, headers and body)
+// to w, for debugging.  Bodies are truncated to 64 KiB.
+//
+// WebSocket requests and server-sent events (requests accepting
+// "text/event-stream") are passed to the next handler without dumping them.
+func DumpMiddleware(w io.Writer) func(http.Handler) http.Handler {
+	var mu sync.Mutex
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			if IsWebSocket(r) || strings.Contains(r.Header.Get("Accept"), "text/event-stream") {
+				next.ServeHTTP(rw, r)
+				return
+			}
+			var buf bytes.Buffer
+			head, _ := httputil.DumpRequest(r, false)
+			buf.Write(head)
+			if r.Body != nil && r.Body != http.NoBody {
+				body, err := io.ReadAll(io.LimitReader(r.Body, dumpMaxBody+1))
+				r.Body = struct {
+					io.Reader
+					io.Closer
+				}{io.MultiReader(bytes.NewReader(body), r.Body), r.Body}
+				writeDumpBody(&buf, body)
+				if err != nil {
+					fmt.Fprintf(&buf, "[error reading body: %v]\n", err)
+				}
+			}
+
+			dw := &dumpWriter{ResponseWriter: rw}
+			next.ServeHTTP(dw, r)
+
+			fmt.Fprintf(&buf, "\n%s %d %s\r\n", r.Proto, dw.Status(), http.StatusText(dw.Status()))
+			rw.Header().Write(&buf)
+			buf.WriteString("\r\n")
+			writeDumpBody(&buf, dw.body.Bytes())
+			buf.WriteString("\n")
+			mu.Lock()
+			defer mu.Unlock()
+			w.Write(buf.Bytes())
+		})
+	}
+}
+
+// writeDumpBody writes a body captured by DumpMiddleware to buf,
+// truncated to dumpMaxBody bytes.
+func writeDumpBody(buf *bytes.Buffer, body []byte) {
+	if len(body) > dumpMaxBody {
+		buf.Write(body[:dumpMaxBody])
+		buf.WriteString("\n[body truncated]\n")
+		return
+	}
+	buf.Write(body)
+	if len(body) > 0 && body[len(body)-1] != '\n' {
+		buf.WriteString("\n")
+	}
+}
+
+// dumpWriter is a http.ResponseWriter which keeps the status
+// and the first bytes of the body written by DumpMiddleware.
+type dumpWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (w *dumpWriter) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *dumpWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	if n := dumpMaxBody + 1 - w.body.Len(); n > 0 {
+		w.body.Write(b[:min(n, len(b))])
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Status returns the status code of the response.
+func (w *dumpWriter) Status() int {
+	if w.status == 0 {
+		return http.StatusOK
+	}
+	return w.status
+}
+
+func (w *dumpWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// TimeoutMiddleware returns a middleware which limits the time taken by
+// the next handler to d, like http.TimeoutHandler.  The context of the request
+// is given a deadline, so handlers can check r.Context().Done() to bail early.
+//
+// The response of the handler is buffered.  If it does not finish in time,
+// a 503 Service Unavailable error is sent instead, and anything written
+// afterwards by the handler is discarded.
+//
+// WebSocket requests and server-sent events (requests accepting
+// "text/event-stream") are passed to the next handler without a time limit.
+func TimeoutMiddleware(d time.Duration) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if IsWebSocket(r) || strings.Contains(r.Header.Get("Accept"), "text/event-stream") {
+				next.ServeHTTP(w, r)
+				return
+			}
+			ctx, cancel := context.WithTimeout(r.Context(), d)
+			defer cancel()
+			tw := &timeoutWriter{header: make(http.Header)}
+			// the handler gets tw as the ResponseWriter installed by the Server,
+			// so nothing it does (like Request.SetCookie) writes to w directly.
+			rw := &ResponseWriter{ResponseWriter: tw}
+			hr := r.WithContext(context.WithValue(ctx, contextResponseWriter{}, rw))
+			done := make(chan struct{})
+			panicChan := make(chan any, 1)
+			go func() {
+				defer func() {
+					if p := recover(); p != nil {
+						panicChan <- p
+					}
+				}()
+				next.ServeHTTP(rw, hr)
+				close(done)
+			}()
+			select {
+			case p := <-panicChan:
+				panic(p)
+			case <-done:
+				tw.mu.Lock()
+				defer tw.mu.Unlock()
+				if outer := requestResponseWriter(r); outer != nil {
+					outer.pattern = rw.pattern
+				}
+				maps.Copy(w.Header(), tw.header)
+				if tw.code == 0 {
+					tw.code = http.StatusOK
+				}
+				w.WriteHeader(tw.code)
+				w.Write(tw.body.Bytes())
+			case <-ctx.Done():
+				tw.mu.Lock()
+				defer tw.mu.Unlock()
+				tw.timedOut = true
+				httpCodeError(w, r, http.StatusServiceUnavailable, "timeout")
+			}
+		})
+	}
+}
+
+// timeoutWriter is a http.ResponseWriter which buffers
+// the response written by a handler run by TimeoutMiddleware.
+type timeoutWriter struct {
+	mu       sync.Mutex
+	header   http.Header
+	code     int
+	body     bytes.Buffer
+	timedOut bool
+}
+
+func (w *timeoutWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *timeoutWriter) WriteHeader(code int) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.timedOut || w.code != 0 {
+		return
+	}
+	w.code = code
+}
+
+func (w *timeoutWriter) Write(b []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.timedOut {
+		return 0, http.ErrHandlerTimeout
+	}
+	if w.code == 0 {
+		w.code = http.StatusOK
+	}
+	return w.body.Write(b)
+}
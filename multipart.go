@@ -0,0 +1,136 @@
+package api
+
+import (
+	"fmt"
+	"io"
+	"maps"
+	"mime/multipart"
+	"net/textproto"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// PostMultipart makes a HTTP POST request to the API, sending a
+// "multipart/form-data" body with the provided fields and files,
+// and decodes the response into dest.
+//
+// The keys of files are the field names.  If a file has a Name method
+// (like *os.File), it is used as the file name; otherwise, the field name is used.
+// Files are streamed, not buffered in memory.
+//
+// To set the content type of every file, use a MultipartBuilder.
+func (c *Client) PostMultipart(URL string, fields map[string]string, files map[string]io.Reader, dest any, opts ...RequestOption) error {
+	b := NewMultipartBuilder()
+	for _, name := range slices.Sorted(maps.Keys(fields)) {
+		b.AddField(name, fields[name])
+	}
+	for _, name := range slices.Sorted(maps.Keys(files)) {
+		r := files[name]
+		filename := name
+		if f, ok := r.(interface{ Name() string }); ok {
+			filename = filepath.Base(f.Name())
+		}
+		b.AddFile(name, filename, "", r)
+	}
+	body := b.Reader()
+	opts = append([]RequestOption{Header("Content-Type", b.ContentType())}, opts...)
+	err := c.Request("POST", URL, body, dest, opts...)
+	// in case the request failed before reading the whole body:
+	body.Close()
+	return err
+}
+
+// MultipartBuilder builds a "multipart/form-data" body,
+// with control over the headers of every part.
+//
+// The body can be sent with any request method:
+//
+//	b := api.NewMultipartBuilder().
+//		AddField("title", "logo").
+//		AddFile("image", "logo.png", "image/png", f)
+//	err := c.Post("/upload", b.Reader(), &dest, api.Header("Content-Type", b.ContentType()))
+type MultipartBuilder struct {
+	boundary string
+	parts    []multipartPart
+}
+
+type multipartPart struct {
+	header textproto.MIMEHeader
+	value  string    // used if r is nil
+	r      io.Reader // contents of a file
+}
+
+// NewMultipartBuilder returns an empty MultipartBuilder with a random boundary.
+func NewMultipartBuilder() *MultipartBuilder {
+	return &MultipartBuilder{boundary: multipart.NewWriter(io.Discard).Boundary()}
+}
+
+var quoteEscaper = strings.NewReplacer("\\", "\\\\", `"`, "\\\"")
+
+// AddField adds a form field.
+func (b *MultipartBuilder) AddField(name, value string) *MultipartBuilder {
+	h := make(textproto.MIMEHeader)
+	h.Set("Content-Disposition", fmt.Sprintf(`form-data; name="%s"`, quoteEscaper.Replace(name)))
+	b.parts = append(b.parts, multipartPart{header: h, value: value})
+	return b
+}
+
+// AddFile adds a file, whose contents are read from r.
+// If contentType is empty, "application/octet-stream" is used.
+func (b *MultipartBuilder) AddFile(field, filename, contentType string, r io.Reader) *MultipartBuilder {
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	h := make(textproto.MIMEHeader)
+	h.Set("Content-Disposition", fmt.Sprintf(`form-data; name="%s"; filename="%s"`,
+		quoteEscaper.Replace(field), quoteEscaper.Replace(filename)))
+	h.Set("Content-Type", contentType)
+	b.parts = append(b.parts, multipartPart{header: h, r: r})
+	return b
+}
+
+// Boundary returns the boundary used to separate the parts.
+func (b *MultipartBuilder) Boundary() string {
+	return b.boundary
+}
+
+// ContentType returns the Content-Type to be sent with the body,
+// including the boundary.
+func (b *MultipartBuilder) ContentType() string {
+	return "multipart/form-data; boundary=" + b.boundary
+}
+
+// Reader returns the body, with all the parts in the order they were added.
+// Files are streamed, not buffered in memory, so Reader can only be used once.
+// Closing it before reading the whole body stops reading the files.
+func (b *MultipartBuilder) Reader() io.ReadCloser {
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(b.write(pw))
+	}()
+	return pr
+}
+
+// write writes all the parts to w, and the closing boundary.
+func (b *MultipartBuilder) write(w io.Writer) error {
+	mw := multipart.NewWriter(w)
+	if err := mw.SetBoundary(b.boundary); err != nil {
+		return err
+	}
+	for _, p := range b.parts {
+		part, err := mw.CreatePart(p.header)
+		if err != nil {
+			return err
+		}
+		if p.r == nil {
+			_, err = io.WriteString(part, p.value)
+		} else {
+			_, err = io.Copy(part, p.r)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return mw.Close()
+}
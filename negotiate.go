@@ -0,0 +1,268 @@
+package api
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// errNotAcceptable is returned by an encoder which cannot encode
+// a value in its media type.
+var errNotAcceptable = errors.New("output cannot be encoded in the requested media type")
+
+// builtinMediaTypes are the media types that can always be sent,
+// in order of preference.
+var builtinMediaTypes = []string{"application/json", "text/csv"}
+
+// RegisterEncoder adds an encoder for a media type, used to send
+// the output of the handlers to requests accepting that type
+// (see the Accept header).
+// If there is no Accept header, or none of the media types with
+// an encoder is acceptable, the output is sent as JSON.
+//
+// The built-in media types are "application/json" and "text/csv";
+// registering an encoder for them replaces the built-in one.
+// If enc returns an error, the response is a 500 Internal Server Error.
+//
+// RegisterEncoder must not be called concurrently with ServeHTTP.
+func (s *Server) RegisterEncoder(mediaType string, enc func(io.Writer, any) error) {
+	if s.encoders == nil {
+		s.encoders = make(map[string]func(io.Writer, any) error)
+	}
+	if _, ok := s.encoders[mediaType]; !ok && !slices.Contains(builtinMediaTypes, mediaType) {
+		s.mediaTypes = append(s.mediaTypes, mediaType)
+	}
+	s.encoders[mediaType] = enc
+}
+
+// negotiate returns the media type to be used in the response to r,
+// according to its Accept header.
+// If there is no Accept header or none of the media types is acceptable,
+// it returns "application/json".
+func negotiate(r *http.Request) string {
+	if r == nil {
+		return builtinMediaTypes[0]
+	}
+	accept := r.Header.Values("Accept")
+	if len(accept) == 0 {
+		return builtinMediaTypes[0]
+	}
+	mediaTypes := builtinMediaTypes
+	if s := requestServer(r); s != nil {
+		mediaTypes = slices.Concat(builtinMediaTypes, s.mediaTypes)
+	}
+	best, bestQ := builtinMediaTypes[0], 0.0
+	for _, mt := range mediaTypes {
+		if q := acceptQuality(accept, mt); q > bestQ {
+			best, bestQ = mt, q
+		}
+	}
+	return best
+}
+
+// acceptQuality returns the quality factor ("q") given to mediaType
+// in the Accept header values, using the most specific matching range.
+func acceptQuality(accept []string, mediaType string) float64 {
+	typ, _, _ := strings.Cut(mediaType, "/")
+	q, specificity := 0.0, -1
+	for _, value := range accept {
+		for _, rng := range strings.Split(value, ",") {
+			mr, params, err := mime.ParseMediaType(strings.TrimSpace(rng))
+			if err != nil {
+				continue
+			}
+			var s int
+			switch {
+			case mr == mediaType:
+				s = 2
+			case mr == typ+"/*":
+				s = 1
+			case mr == "*/*":
+				s = 0
+			default:
+				continue
+			}
+			if s <= specificity {
+				continue
+			}
+			specificity = s
+			q = 1
+			if v, ok := params["q"]; ok {
+				if f, err := strconv.ParseFloat(v, 64); err == nil {
+					q = f
+				}
+			}
+		}
+	}
+	return q
+}
+
+// PreferredLanguage returns the language in supported (eg, "en" or "es-ES")
+// preferred by the client, according to the Accept-Language header of the request,
+// so handlers can localize their responses.
+//
+// A language range in the header matches a language if they are equal
+// or if one of them is a prefix of the other followed by "-"
+// (so "es" matches "es-ES" and vice versa), and "*" matches every language.
+// In case of a tie, the first one in supported wins.
+//
+// If there is no Accept-Language header or none of the languages
+// is acceptable, it returns the first one in supported, or "" if it is empty.
+func (r *Request) PreferredLanguage(supported ...string) string {
+	if len(supported) == 0 {
+		return ""
+	}
+	accept := r.Header.Values("Accept-Language")
+	best, bestQ := supported[0], 0.0
+	for _, lang := range supported {
+		if q := languageQuality(accept, lang); q > bestQ {
+			best, bestQ = lang, q
+		}
+	}
+	return best
+}
+
+// languageQuality returns the quality factor ("q") given to lang
+// in the Accept-Language header values, using the most specific matching range.
+func languageQuality(accept []string, lang string) float64 {
+	q, specificity := 0.0, -1
+	for _, value := range accept {
+		for _, rng := range strings.Split(value, ",") {
+			rng, params, _ := strings.Cut(rng, ";")
+			rng = strings.TrimSpace(rng)
+			var s int
+			switch {
+			case rng == "*":
+				s = 0
+			case strings.EqualFold(rng, lang),
+				len(rng) < len(lang) && strings.EqualFold(lang[:len(rng)], rng) && lang[len(rng)] == '-',
+				len(lang) < len(rng) && strings.EqualFold(rng[:len(lang)], lang) && rng[len(lang)] == '-':
+				s = len(rng)
+			default:
+				continue
+			}
+			if s <= specificity {
+				continue
+			}
+			specificity = s
+			q = 1
+			if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+				if f, err := strconv.ParseFloat(v, 64); err == nil {
+					q = f
+				}
+			}
+		}
+	}
+	return q
+}
+
+// jsonEncoder returns a JSON encoder writing to w,
+// with the options set in the Server (s can be nil).
+func (s *Server) jsonEncoder(w io.Writer) *json.Encoder {
+	e := json.NewEncoder(w)
+	if s != nil {
+		e.SetEscapeHTML(!s.noEscapeHTML)
+		if s.jsonPrefix != "" || s.jsonIndent != "" {
+			e.SetIndent(s.jsonPrefix, s.jsonIndent)
+		}
+	}
+	return e
+}
+
+// encodeOutput writes the encoding of v in the given media type to w.
+func encodeOutput(w io.Writer, r *http.Request, mediaType string, v any) error {
+	if s := requestServer(r); s != nil {
+		if enc, ok := s.encoders[mediaType]; ok {
+			return enc(w, v)
+		}
+	}
+	switch mediaType {
+	case "text/csv":
+		return encodeCSV(w, v)
+	default:
+		s := requestServer(r)
+		if s != nil && s.marshaler != nil {
+			return s.marshaler(w, v)
+		}
+		return s.jsonEncoder(w).Encode(v)
+	}
+}
+
+// encodeCSV writes v, which must be a slice or array of structs
+// (or pointers to structs), as CSV: a header row with the field names
+// and a row for every element.
+//
+// The name of every field is taken from its "csv" tag, its "json" tag
+// or the field name.  Fields with the tag "-" and unexported fields are omitted.
+func encodeCSV(w io.Writer, v any) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Slice && rv.Kind() != reflect.Array {
+		return fmt.Errorf("%w: %T is not a slice", errNotAcceptable, v)
+	}
+	et := rv.Type().Elem()
+	if et.Kind() == reflect.Pointer {
+		et = et.Elem()
+	}
+	if et.Kind() != reflect.Struct {
+		return fmt.Errorf("%w: %T is not a slice of structs", errNotAcceptable, v)
+	}
+
+	var fields []int
+	var header []string
+	for i := 0; i < et.NumField(); i++ {
+		f := et.Field(i)
+		if !f.IsExported() {
+			continue
+		}
+		name := f.Name
+		for _, key := range []string{"csv", "json"} {
+			if tag, _, _ := strings.Cut(f.Tag.Get(key), ","); tag != "" {
+				name = tag
+				break
+			}
+		}
+		if name == "-" {
+			continue
+		}
+		fields = append(fields, i)
+		header = append(header, name)
+	}
+
+	cw := csv.NewWriter(w)
+	cw.Write(header)
+	row := make([]string, len(fields))
+	for i := 0; i < rv.Len(); i++ {
+		ev := rv.Index(i)
+		if ev.Kind() == reflect.Pointer {
+			if ev.IsNil() {
+				continue
+			}
+			ev = ev.Elem()
+		}
+		for j, f := range fields {
+			row[j] = csvValue(ev.Field(f))
+		}
+		cw.Write(row)
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// csvValue returns the text representation of a value in a CSV field.
+func csvValue(v reflect.Value) string {
+	for v.Kind() == reflect.Pointer || v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			return ""
+		}
+		v = v.Elem()
+	}
+	return fmt.Sprint(v.Interface())
+}
@@ -0,0 +1,238 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// OpenAPI returns an OpenAPI 3 document in JSON describing the handlers
+// registered in the Server, with the schemas of their inputs and outputs
+// taken from the types of the handler functions.
+//
+// Handlers registered as http.Handler or func(http.ResponseWriter, *http.Request)
+// are listed with no schemas.  Patterns with no method are listed
+// as POST if their handler has an Input, and as GET otherwise.
+func (s *Server) OpenAPI() ([]byte, error) {
+	g := openAPIGen{schemas: map[string]any{
+		"Error": map[string]any{
+			"type":       "object",
+			"properties": map[string]any{"error": map[string]any{"type": "string"}},
+		},
+	}}
+	paths := make(map[string]any)
+	for i, pattern := range s.patterns {
+		method, path := openAPIPath(pattern)
+		if method == "" {
+			method = "GET"
+			if t := handlerFunc(s.handlers[i]); t != nil && t.NumIn() == 2 {
+				method = "POST"
+			}
+		}
+		op := g.operation(s.handlers[i], method, path)
+		item, ok := paths[path].(map[string]any)
+		if !ok {
+			item = make(map[string]any)
+			paths[path] = item
+		}
+		item[strings.ToLower(method)] = op
+	}
+	return json.MarshalIndent(map[string]any{
+		"openapi":    "3.0.3",
+		"info":       map[string]any{"title": "API", "version": "1.0.0"},
+		"paths":      paths,
+		"components": map[string]any{"schemas": g.schemas},
+	}, "", "  ")
+}
+
+// openAPIPath returns the method and the path in a pattern,
+// with the wildcards in OpenAPI syntax ("{name}").
+func openAPIPath(pattern string) (method, path string) {
+	if m, p, found := strings.Cut(pattern, " "); found {
+		method, pattern = m, strings.TrimLeft(p, " \t")
+	}
+	if i := strings.Index(pattern, "/"); i > 0 {
+		pattern = pattern[i:] // remove the host
+	}
+	pattern = strings.TrimSuffix(pattern, "{$}")
+	return method, strings.ReplaceAll(pattern, "...}", "}")
+}
+
+// openAPIGen holds the state of the generation of an OpenAPI document.
+type openAPIGen struct {
+	schemas map[string]any // named schemas, in components
+}
+
+// operation returns the OpenAPI operation for a handler of method and path.
+func (g *openAPIGen) operation(handler any, method, path string) map[string]any {
+	op := map[string]any{
+		"responses": map[string]any{
+			"default": map[string]any{
+				"description": "Error",
+				"content":     jsonContent(map[string]any{"$ref": "#/components/schemas/Error"}),
+			},
+		},
+	}
+	var params []any
+	for _, seg := range strings.Split(path, "/") {
+		if strings.HasPrefix(seg, "{") && strings.HasSuffix(seg, "}") {
+			params = append(params, map[string]any{
+				"name":     seg[1 : len(seg)-1],
+				"in":       "path",
+				"required": true,
+				"schema":   map[string]any{"type": "string"},
+			})
+		}
+	}
+	defer func() {
+		if len(params) > 0 {
+			op["parameters"] = params
+		}
+	}()
+	t := handlerFunc(handler)
+	if t == nil {
+		return op
+	}
+	if t.NumIn() == 2 {
+		in := t.In(1)
+		var query []any
+		if in.Kind() == reflect.Struct && (method == "GET" || method == "HEAD" || method == "DELETE") {
+			queryFields(in, func(i int, name string, _ bool) {
+				query = append(query, map[string]any{
+					"name":   name,
+					"in":     "query",
+					"schema": g.schema(in.Field(i).Type),
+				})
+			})
+		}
+		if len(query) > 0 {
+			params = append(params, query...)
+		} else {
+			op["requestBody"] = map[string]any{
+				"required": true,
+				"content":  jsonContent(g.schema(in)),
+			}
+		}
+	}
+	if t.NumOut() == 1 {
+		op["responses"].(map[string]any)["204"] = map[string]any{"description": "No Content"}
+		return op
+	}
+	out := t.Out(0)
+	if out.Kind() == reflect.Chan {
+		out = out.Elem()
+	}
+	var schema any
+	if out.Kind() == reflect.String {
+		schema = map[string]any{
+			"type":       "object",
+			"properties": map[string]any{"info": map[string]any{"type": "string"}},
+		}
+	} else {
+		schema = g.schema(out)
+	}
+	op["responses"].(map[string]any)["200"] = map[string]any{
+		"description": "OK",
+		"content":     jsonContent(schema),
+	}
+	return op
+}
+
+// handlerFunc returns the type of handler if it is a function
+// with a *Request as the first argument, or nil otherwise.
+func handlerFunc(handler any) reflect.Type {
+	if _, ok := handler.(http.Handler); ok {
+		return nil
+	}
+	if _, ok := handler.(func(http.ResponseWriter, *http.Request)); ok {
+		return nil
+	}
+	return reflect.TypeOf(handler)
+}
+
+func jsonContent(schema any) map[string]any {
+	return map[string]any{"application/json": map[string]any{"schema": schema}}
+}
+
+var (
+	timeType  = reflect.TypeFor[time.Time]()
+	bytesType = reflect.TypeFor[[]byte]()
+)
+
+// schema returns the JSON schema of the values of type t, encoded with encoding/json.
+// Named structs are added to g.schemas and referenced.
+func (g *openAPIGen) schema(t reflect.Type) map[string]any {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	switch {
+	case t == timeType:
+		return map[string]any{"type": "string", "format": "date-time"}
+	case t == bytesType:
+		return map[string]any{"type": "string", "format": "byte"}
+	}
+	switch t.Kind() {
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]any{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]any{"type": "number"}
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		return map[string]any{"type": "array", "items": g.schema(t.Elem())}
+	case reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": g.schema(t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return g.structSchema(t)
+		}
+		ref := map[string]any{"$ref": "#/components/schemas/" + t.Name()}
+		if _, ok := g.schemas[t.Name()]; !ok {
+			g.schemas[t.Name()] = nil // in case t is recursive
+			g.schemas[t.Name()] = g.structSchema(t)
+		}
+		return ref
+	}
+	return map[string]any{}
+}
+
+// structSchema returns the JSON schema of a struct, with a property
+// for every field encoded by encoding/json.
+func (g *openAPIGen) structSchema(t reflect.Type) map[string]any {
+	props := make(map[string]any)
+	g.addFields(t, props)
+	return map[string]any{"type": "object", "properties": props}
+}
+
+// addFields adds the fields of struct type t to props,
+// including the ones of embedded structs.
+func (g *openAPIGen) addFields(t reflect.Type, props map[string]any) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, _, _ := strings.Cut(tag, ",")
+		ft := f.Type
+		for ft.Kind() == reflect.Pointer {
+			ft = ft.Elem()
+		}
+		if f.Anonymous && name == "" && ft.Kind() == reflect.Struct {
+			g.addFields(ft, props)
+			continue
+		}
+		if !f.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		props[name] = g.schema(f.Type)
+	}
+}
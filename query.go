@@ -0,0 +1,229 @@
+package api
+
+import (
+	"encoding"
+	"fmt"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// queryFields calls f for every field in struct type t with a "query" tag,
+// with the name and options in that tag.
+func queryFields(t reflect.Type, f func(i int, name string, omitempty bool)) {
+	for i := 0; i < t.NumField(); i++ {
+		tag, ok := t.Field(i).Tag.Lookup("query")
+		if !ok || !t.Field(i).IsExported() {
+			continue
+		}
+		name, opts, _ := strings.Cut(tag, ",")
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = t.Field(i).Name
+		}
+		f(i, name, opts == "omitempty")
+	}
+}
+
+// encodeQuery returns the query parameters taken from the fields
+// in the struct params (or pointer to struct) with a "query" tag.
+//
+// The tag is the name of the parameter, optionally followed by ",omitempty"
+// to omit it when the field has a zero value.
+// Slices and arrays are sent as repeated parameters.
+func encodeQuery(params any) (url.Values, error) {
+	v := reflect.ValueOf(params)
+	for v.Kind() == reflect.Pointer {
+		if v.IsNil() {
+			return nil, nil
+		}
+		v = v.Elem()
+	}
+	if v.Kind() != reflect.Struct {
+		return nil, fmt.Errorf("api: query parameters must be a struct, not %T", params)
+	}
+	values := make(url.Values)
+	var err error
+	queryFields(v.Type(), func(i int, name string, omitempty bool) {
+		fv := v.Field(i)
+		if err != nil || (omitempty && fv.IsZero()) {
+			return
+		}
+		if fv.Kind() == reflect.Slice || fv.Kind() == reflect.Array {
+			for j := 0; j < fv.Len(); j++ {
+				s, e := queryValue(fv.Index(j))
+				if e != nil {
+					err = fmt.Errorf("api: query parameter %q: %w", name, e)
+					return
+				}
+				values.Add(name, s)
+			}
+			return
+		}
+		if fv.Kind() == reflect.Pointer && fv.IsNil() {
+			return
+		}
+		s, e := queryValue(fv)
+		if e != nil {
+			err = fmt.Errorf("api: query parameter %q: %w", name, e)
+			return
+		}
+		values.Add(name, s)
+	})
+	return values, err
+}
+
+// queryValue returns the text representation of a value in a query parameter.
+func queryValue(v reflect.Value) (string, error) {
+	for v.Kind() == reflect.Pointer {
+		if v.IsNil() {
+			return "", nil
+		}
+		v = v.Elem()
+	}
+	if tm, ok := v.Interface().(encoding.TextMarshaler); ok {
+		b, err := tm.MarshalText()
+		return string(b), err
+	}
+	switch v.Kind() {
+	case reflect.String:
+		return v.String(), nil
+	case reflect.Bool:
+		return strconv.FormatBool(v.Bool()), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return strconv.FormatInt(v.Int(), 10), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return strconv.FormatUint(v.Uint(), 10), nil
+	case reflect.Float32, reflect.Float64:
+		return strconv.FormatFloat(v.Float(), 'g', -1, v.Type().Bits()), nil
+	}
+	return "", fmt.Errorf("unsupported type %s", v.Type())
+}
+
+// GetStruct makes a HTTP GET request to the API, with query parameters
+// taken from the fields in params with a "query" tag, like:
+//
+//	type ListParams struct {
+//		Page  int      `query:"page,omitempty"`
+//		Tags  []string `query:"tag"`
+//		Draft bool     `query:"draft"`
+//	}
+//
+// The parameters are added to the query in url, if any.
+func (c *Client) GetStruct(url string, params any, dest any, opts ...RequestOption) error {
+	values, err := encodeQuery(params)
+	if err != nil {
+		return err
+	}
+	if len(values) > 0 {
+		sep := "?"
+		if strings.Contains(url, "?") {
+			sep = "&"
+		}
+		url += sep + values.Encode()
+	}
+	return c.Get(url, dest, opts...)
+}
+
+// decodeQuery sets the fields in the struct pointed to by dest
+// with a "query" tag to the values of the query parameters with that name.
+// Fields without a parameter in values are left unchanged.
+// Errors converting the values have a 400 Bad Request HTTP status.
+func decodeQuery(values url.Values, dest any) error {
+	v := reflect.ValueOf(dest)
+	if v.Kind() != reflect.Pointer || v.IsNil() || v.Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("api: query destination must be a pointer to struct, not %T", dest)
+	}
+	v = v.Elem()
+	var err error
+	queryFields(v.Type(), func(i int, name string, _ bool) {
+		vals, ok := values[name]
+		if err != nil || !ok {
+			return
+		}
+		fv := v.Field(i)
+		if fv.Kind() == reflect.Slice && !reflect.PointerTo(fv.Type()).Implements(textUnmarshalerType) {
+			s := reflect.MakeSlice(fv.Type(), len(vals), len(vals))
+			for j, val := range vals {
+				if e := setQueryValue(s.Index(j), val); e != nil {
+					err = HTTPError(http.StatusBadRequest, "query parameter %q: %w", name, e)
+					return
+				}
+			}
+			fv.Set(s)
+			return
+		}
+		if e := setQueryValue(fv, vals[0]); e != nil {
+			err = HTTPError(http.StatusBadRequest, "query parameter %q: %w", name, e)
+		}
+	})
+	return err
+}
+
+var textUnmarshalerType = reflect.TypeFor[encoding.TextUnmarshaler]()
+
+// setQueryValue sets v from the text representation of a query parameter.
+func setQueryValue(v reflect.Value, s string) error {
+	if v.Kind() == reflect.Pointer {
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		return setQueryValue(v.Elem(), s)
+	}
+	if tu, ok := v.Addr().Interface().(encoding.TextUnmarshaler); ok {
+		return tu.UnmarshalText([]byte(s))
+	}
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(s)
+		return nil
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return fmt.Errorf("%q is not a boolean", s)
+		}
+		v.SetBool(b)
+		return nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		i, err := strconv.ParseInt(s, 10, v.Type().Bits())
+		if err != nil {
+			return fmt.Errorf("%q is not a valid %s", s, v.Type())
+		}
+		v.SetInt(i)
+		return nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		u, err := strconv.ParseUint(s, 10, v.Type().Bits())
+		if err != nil {
+			return fmt.Errorf("%q is not a valid %s", s, v.Type())
+		}
+		v.SetUint(u)
+		return nil
+	case reflect.Float32, reflect.Float64:
+		f, err := strconv.ParseFloat(s, v.Type().Bits())
+		if err != nil {
+			return fmt.Errorf("%q is not a valid %s", s, v.Type())
+		}
+		v.SetFloat(f)
+		return nil
+	}
+	return fmt.Errorf("unsupported type %s", v.Type())
+}
+
+// BindQuery sets the fields in the struct pointed to by dest
+// with a "query" tag (see Client.GetStruct) to the values
+// of the query parameters in the request URL.
+//
+// Supported field types are strings, booleans, numbers, types implementing
+// encoding.TextUnmarshaler, and slices or pointers to them.
+// Slices get all the values of a repeated parameter; other fields get the first one.
+// Fields with no parameter in the query are left unchanged.
+//
+// If a value cannot be converted to the type of its field,
+// the error has a 400 Bad Request HTTP status.
+func (r *Request) BindQuery(dest any) error {
+	return decodeQuery(r.URL.Query(), dest)
+}
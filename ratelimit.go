@@ -0,0 +1,151 @@
+package api
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// rateLimiter is a set of token buckets, one for every key.
+type rateLimiter struct {
+	rate  float64 // tokens added per second
+	burst int     // maximum number of tokens in a bucket
+
+	mu          sync.Mutex
+	buckets     map[string]*bucket
+	lastCleanup time.Time
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// rateLimitCleanup is how often the idle buckets are removed.
+const rateLimitCleanup = time.Minute
+
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	return &rateLimiter{
+		rate:        rate,
+		burst:       burst,
+		buckets:     make(map[string]*bucket),
+		lastCleanup: time.Now(),
+	}
+}
+
+// allow reports whether a request with this key is allowed now.
+// If it is not, it also returns how long until it would be.
+func (l *rateLimiter) allow(key string) (bool, time.Duration) {
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if now.Sub(l.lastCleanup) > rateLimitCleanup {
+		l.cleanup(now)
+	}
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: float64(l.burst), last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = min(float64(l.burst), b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	if l.rate <= 0 {
+		return false, rateLimitCleanup
+	}
+	return false, time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+}
+
+// cleanup removes the buckets which would be full by now,
+// as they are the same as a new one.
+func (l *rateLimiter) cleanup(now time.Time) {
+	for key, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.rate >= float64(l.burst) {
+			delete(l.buckets, key)
+		}
+	}
+	l.lastCleanup = now
+}
+
+// middleware returns a middleware which limits the requests
+// using a different bucket for every key returned by keyFn.
+// Requests over the limit get a 429 Too Many Requests response
+// with a Retry-After header and a JSON body like
+// {"error": "rate limited", "retry_after": 3}, with the same number of seconds.
+// If the Server has an error encoder (see Server.SetErrorEncoder),
+// it is used for the body instead.
+func (l *rateLimiter) middleware(keyFn func(*http.Request) string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ok, wait := l.allow(keyFn(r))
+			if !ok {
+				secs := int(math.Ceil(wait.Seconds()))
+				w.Header().Set("Retry-After", strconv.Itoa(secs))
+				s := requestServer(r)
+				if s != nil && s.errorEncoder != nil {
+					httpCodeError(w, r, http.StatusTooManyRequests, "rate limited")
+					return
+				}
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusTooManyRequests)
+				s.jsonEncoder(w).Encode(struct {
+					Error      string `json:"error"`
+					RetryAfter int    `json:"retry_after"`
+				}{"rate limited", secs})
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// clientIP returns the IP address of the client making the request.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// WithRateLimit is a HandleOption that limits the number of requests
+// to a route from every client IP address, using a token bucket
+// refilled at rps tokens per second, with a maximum of burst tokens.
+//
+// Every route has its own limit, even if they use the same HandleOption.
+// It applies in addition to any limit set by middlewares in the Server.
+func WithRateLimit(rps float64, burst int) HandleOption {
+	return func(rt *route) {
+		l := newRateLimiter(rps, burst)
+		rt.middlewares = append(rt.middlewares, l.middleware(clientIP))
+	}
+}
+
+// RateLimit returns a middleware which limits the number of requests
+// from every client, using a token bucket refilled at perSecond tokens
+// per second, with a maximum of burst tokens.
+//
+// Clients are identified by the key returned by keyFn, which can be taken
+// from the request (eg, an API token) or from the values set with Request.Set
+// by a previous middleware (eg, the user ID).  If keyFn is nil,
+// the client IP address is used.
+//
+// Requests over the limit get a 429 Too Many Requests response
+// with a Retry-After header.  The buckets of idle clients are removed
+// periodically, so the memory used does not grow without bound.
+func RateLimit(perSecond float64, burst int, keyFn func(*Request) string) func(http.Handler) http.Handler {
+	key := clientIP
+	if keyFn != nil {
+		key = func(r *http.Request) string {
+			return keyFn(&Request{r})
+		}
+	}
+	return newRateLimiter(perSecond, burst).middleware(key)
+}
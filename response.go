@@ -0,0 +1,114 @@
+package api
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"net/http"
+	"time"
+)
+
+// RequestInfo describes a request handled by a Server, after its handler returns.
+type RequestInfo struct {
+	Method   string
+	Path     string
+	Pattern  string // Pattern of the matched handler, if any
+	Status   int
+	Bytes    int64 // Number of bytes written in the response body
+	Duration time.Duration
+}
+
+// ResponseWriter wraps a http.ResponseWriter, recording the status code
+// and the number of bytes written.
+//
+// The Server installs one for every request, before calling the middlewares,
+// so they do not need to wrap the http.ResponseWriter to know the status code
+// or the size of the response: it is available with Request.Status
+// and Request.BytesWritten after calling the next handler.
+type ResponseWriter struct {
+	http.ResponseWriter
+	status  int
+	bytes   int64
+	pattern string
+}
+
+type contextResponseWriter struct{}
+
+// requestResponseWriter returns the ResponseWriter installed
+// by the Server for this request, or nil if there is none.
+func requestResponseWriter(r *http.Request) *ResponseWriter {
+	rw, _ := r.Context().Value(contextResponseWriter{}).(*ResponseWriter)
+	return rw
+}
+
+func (w *ResponseWriter) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *ResponseWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += int64(n)
+	return n, err
+}
+
+// Status returns the status code sent, or 200 if it has not been set.
+func (w *ResponseWriter) Status() int {
+	if w.status == 0 {
+		return http.StatusOK
+	}
+	return w.status
+}
+
+// BytesWritten returns the number of bytes written in the response body.
+func (w *ResponseWriter) BytesWritten() int64 {
+	return w.bytes
+}
+
+// Unwrap returns the underlying http.ResponseWriter (see http.ResponseController).
+func (w *ResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// Flush implements http.Flusher.
+func (w *ResponseWriter) Flush() {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+// Hijack implements http.Hijacker, needed for websockets.
+func (w *ResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if h, ok := w.ResponseWriter.(http.Hijacker); ok {
+		if w.status == 0 {
+			w.status = http.StatusSwitchingProtocols
+		}
+		return h.Hijack()
+	}
+	return nil, nil, errors.New("api: http.Hijacker not implemented")
+}
+
+// Status returns the status code of the response to this request,
+// or 200 if it has not been set yet.
+// It is 0 if the request is not being handled by a Server.
+func (r *Request) Status() int {
+	if rw := requestResponseWriter(r.Request); rw != nil {
+		return rw.Status()
+	}
+	return 0
+}
+
+// BytesWritten returns the number of bytes written in the body
+// of the response to this request.
+func (r *Request) BytesWritten() int {
+	if rw := requestResponseWriter(r.Request); rw != nil {
+		return int(rw.bytes)
+	}
+	return 0
+}
@@ -0,0 +1,81 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// RetryError is returned by a Client when a request fails after being retried.
+type RetryError struct {
+	Attempts int   // Number of attempts made, including the first one
+	Err      error // Error in the last attempt
+}
+
+func (e *RetryError) Error() string {
+	return fmt.Sprintf("%v (after %d attempts)", e.Err, e.Attempts)
+}
+
+func (e *RetryError) Unwrap() error {
+	return e.Err
+}
+
+// retryError wraps err in a *RetryError if there has been more than one attempt.
+func retryError(attempts int, err error) error {
+	if attempts > 1 {
+		return &RetryError{Attempts: attempts, Err: err}
+	}
+	return err
+}
+
+// idempotent reports whether a request with this method can be safely retried.
+func idempotent(method string) bool {
+	switch method {
+	case "GET", "HEAD", "PUT", "DELETE":
+		return true
+	}
+	return false
+}
+
+// shouldRetry reports whether a request with this response or error should be retried.
+func shouldRetry(resp *http.Response, err error) bool {
+	if err != nil {
+		return true
+	}
+	return resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable
+}
+
+// retryDelay returns how long to wait before retrying a request
+// after attempt number attempt (starting at 1).
+func (c *Client) retryDelay(attempt int, resp *http.Response) time.Duration {
+	if resp != nil {
+		if d, err := parseRetryAfter(resp.Header.Get("Retry-After")); err == nil {
+			return d
+		}
+	}
+	d := c.retryBase << (attempt - 1)
+	if d <= 0 {
+		return 0
+	}
+	// jitter: a random delay between d/2 and d
+	return d/2 + rand.N(d/2+1)
+}
+
+// parseRetryAfter parses the value of a Retry-After header,
+// which can be a number of seconds or a HTTP date.
+func parseRetryAfter(s string) (time.Duration, error) {
+	if s == "" {
+		return 0, errors.New("empty Retry-After")
+	}
+	if secs, err := strconv.Atoi(s); err == nil {
+		return max(time.Duration(secs)*time.Second, 0), nil
+	}
+	t, err := http.ParseTime(s)
+	if err != nil {
+		return 0, err
+	}
+	return max(time.Until(t), 0), nil
+}
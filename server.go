@@ -2,27 +2,63 @@ package api
 
 import (
 	"context"
+	"crypto/tls"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
 	"log"
+	"maps"
 	"net"
 	"net/http"
+	"os"
 	"reflect"
+	"slices"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"golang.org/x/net/websocket"
 )
 
 // Server is an HTTP request multiplexer.
 type Server struct {
-	debug       bool
-	mux         *http.ServeMux
-	patterns    []string
-	values      map[string]any // to be added to all the requests
-	middlewares []func(http.Handler) http.Handler
-	once        sync.Once
-	handler     http.Handler
+	// DefaultNetwork is the network used by Serve for the addresses
+	// without an explicit network (eg, "tcp4").  If it is empty,
+	// the network is inferred from the address.
+	DefaultNetwork string
+
+	debug        bool
+	pollStatus   int // status sent when a long-polling handler gets no value
+	errorEncoder func(w http.ResponseWriter, code int, msg string)
+	jsonPrefix   string
+	jsonIndent   string
+	noEscapeHTML bool                                  // do not escape HTML characters in JSON output
+	autoOptions  bool                                  // answer OPTIONS requests with no explicit handler
+	notFound     http.Handler                          // called when no pattern matches
+	maxBodySize  int64                                 // maximum size of the request bodies decoded by Handler
+	encoders     map[string]func(io.Writer, any) error // see RegisterEncoder
+	mediaTypes   []string                              // with an encoder, in order of registration
+	marshaler    func(io.Writer, any) error            // used instead of encoding/json for the outputs
+	mux          *http.ServeMux
+	patterns     []string
+	handlers     []any                          // registered for every pattern
+	values       atomic.Pointer[map[string]any] // to be added to all the requests; copied on every Set
+	valuesMu     sync.Mutex                     // serializes the calls to Set
+	middlewares  []func(http.Handler) http.Handler
+	once         sync.Once
+	handler      http.Handler
+	onComplete   []func(RequestInfo)
+	nInFlight    atomic.Int64  // requests being handled
+	inFlightMu   sync.Mutex    // serializes the changes of nInFlight to and from zero
+	idle         chan struct{} // closed when nInFlight drops to zero
+	srvMu        sync.Mutex
+	servers      []*http.Server // one for every listener in Serve
+	shutdown     chan struct{}  // closed when Shutdown finishes
+	inShutdown   bool           // set when Shutdown is called
+	shutdownOnce sync.Once
 }
 
 // NewServer allocates and returns a new Server.
@@ -30,9 +66,105 @@ func NewServer() *Server {
 	var s Server
 	s.mux = http.NewServeMux()
 	s.debug = false
+	s.pollStatus = http.StatusNoContent
 	return &s
 }
 
+// SetDebug enables or disables the debug mode in the Server.
+//
+// In debug mode, some messages are logged for every request,
+// and RecoverMiddleware includes the stack trace in its responses.
+func (s *Server) SetDebug(debug bool) {
+	s.debug = debug
+}
+
+// SetLongPollStatus sets the HTTP status code sent when a handler returns
+// a channel and the request is cancelled before receiving any value from it.
+// The default is 204 No Content.
+func (s *Server) SetLongPollStatus(code int) {
+	s.pollStatus = code
+}
+
+// SetErrorEncoder sets the function used to send error responses.
+// It receives the resolved HTTP status code and error message.
+// By default, errors are sent as a JSON object like {"error": "message"}.
+func (s *Server) SetErrorEncoder(enc func(w http.ResponseWriter, code int, msg string)) {
+	s.errorEncoder = enc
+}
+
+// SetEscapeHTML specifies whether problematic HTML characters
+// (<, > and &) should be escaped inside JSON quoted strings in the responses.
+// The default is true.
+//
+// It is the same as the NoEscapeHTML field of JSONOptions:
+// SetJSONOptions overrides the value set by SetEscapeHTML, and vice versa.
+func (s *Server) SetEscapeHTML(on bool) {
+	s.noEscapeHTML = !on
+}
+
+// JSONOptions configures the JSON encoding of the responses
+// (see Server.SetJSONOptions).
+type JSONOptions struct {
+	// Prefix and Indent are used to indent the output, like in json.MarshalIndent.
+	// If both are empty, the output is not indented.
+	Prefix string
+	Indent string
+
+	// NoEscapeHTML disables the escaping of problematic HTML characters
+	// (<, > and &) inside JSON quoted strings (see SetEscapeHTML).
+	NoEscapeHTML bool
+}
+
+// SetJSONOptions configures the encoding of the JSON responses
+// sent by the handlers and the middlewares in this package,
+// including the error responses.
+//
+// It replaces all the JSON options, including the one set
+// with SetEscapeHTML: set NoEscapeHTML to keep HTML characters unescaped.
+func (s *Server) SetJSONOptions(opts JSONOptions) {
+	s.jsonPrefix = opts.Prefix
+	s.jsonIndent = opts.Indent
+	s.noEscapeHTML = opts.NoEscapeHTML
+}
+
+// SetMarshaler sets the function used instead of encoding/json
+// to send the JSON output of the handlers, for example to use a faster library.
+// The JSON options (see SetJSONOptions) do not apply to it,
+// and the error responses are still encoded with encoding/json.
+func (s *Server) SetMarshaler(marshal func(w io.Writer, v any) error) {
+	s.marshaler = marshal
+}
+
+// SetAutoOptions enables or disables the automatic responses to OPTIONS requests.
+//
+// When enabled, an OPTIONS request to a path with no handler registered for
+// that method gets a 204 No Content response with an Allow header listing the
+// methods with a registered handler for that path.
+// Handlers registered explicitly for OPTIONS (or for any method) always take precedence.
+func (s *Server) SetAutoOptions(on bool) {
+	s.autoOptions = on
+}
+
+// SetMaxBodySize sets the maximum size of the request bodies decoded
+// by the handlers, after decompressing them.
+// Requests with larger bodies get a 413 Request Entity Too Large response.
+// A size of zero (the default) means no limit.
+func (s *Server) SetMaxBodySize(n int64) {
+	s.maxBodySize = n
+}
+
+// SetNotFound sets the handler called when no pattern matches a request,
+// instead of sending a plain 404 Not Found.
+// handler can be anything accepted by Handler.
+//
+// It runs like the handlers registered with Handle, after the middleware
+// functions, so it can use the values set with Server.Set.
+// Its responses have a 404 status code unless it returns an error
+// with a different one.
+func (s *Server) SetNotFound(handler any) {
+	s.notFound = Handler(handler)
+}
+
 // ServeHTTP creates a Request, runs the middleware functions,
 // and dispatches the HTTP request to the correct handler from
 // those registered in the server.
@@ -40,14 +172,151 @@ func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	if s.debug {
 		log.Printf("api.Server.ServeHTTP: new request: %v", r.URL)
 	}
-	req := s.newRequest(r)
+	s.startRequest()
+	defer s.endRequest()
+	start := time.Now()
+	rw := &ResponseWriter{ResponseWriter: w}
+	req := s.newRequest(r.WithContext(context.WithValue(r.Context(), contextResponseWriter{}, rw)))
 	s.once.Do(func() {
-		s.handler = s.mux
+		s.handler = http.HandlerFunc(s.serveMux)
 		for i := len(s.middlewares) - 1; i >= 0; i-- {
 			s.handler = s.middlewares[i](s.handler)
 		}
 	})
-	s.handler.ServeHTTP(w, req.Request)
+	s.handler.ServeHTTP(rw, req.Request)
+	if len(s.onComplete) > 0 {
+		info := RequestInfo{
+			Method:   r.Method,
+			Path:     r.URL.Path,
+			Pattern:  rw.pattern,
+			Status:   rw.Status(),
+			Bytes:    rw.bytes,
+			Duration: time.Since(start),
+		}
+		for _, f := range s.onComplete {
+			f(info)
+		}
+	}
+}
+
+// serveMux dispatches a request to the handler registered in the mux,
+// or generates a response for OPTIONS if needed.
+func (s *Server) serveMux(w http.ResponseWriter, r *http.Request) {
+	if s.autoOptions && r.Method == "OPTIONS" {
+		if _, pattern := s.mux.Handler(r); pattern == "" {
+			if allow := s.allowedMethods(r); len(allow) > 0 {
+				w.Header().Set("Allow", strings.Join(append(allow, "OPTIONS"), ", "))
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+		}
+	}
+	if s.notFound != nil {
+		if _, pattern := s.mux.Handler(r); pattern == "" && len(s.allowedMethods(r)) == 0 {
+			s.notFound.ServeHTTP(&notFoundWriter{ResponseWriter: w}, r)
+			return
+		}
+	}
+	s.mux.ServeHTTP(w, r)
+}
+
+// notFoundWriter is a http.ResponseWriter which sends
+// 404 Not Found instead of 200 OK.
+type notFoundWriter struct {
+	http.ResponseWriter
+	wroteHeader bool
+}
+
+func (w *notFoundWriter) WriteHeader(code int) {
+	if code == http.StatusOK {
+		code = http.StatusNotFound
+	}
+	w.wroteHeader = true
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *notFoundWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusNotFound)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *notFoundWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// allowedMethods returns the methods with a handler registered for the path in r.
+func (s *Server) allowedMethods(r *http.Request) []string {
+	var allow []string
+	for _, m := range []string{"GET", "HEAD", "POST", "PUT", "PATCH", "DELETE"} {
+		r2 := *r
+		r2.Method = m
+		if _, pattern := s.mux.Handler(&r2); pattern != "" {
+			allow = append(allow, m)
+		}
+	}
+	return allow
+}
+
+// InFlight returns the number of requests being handled by the Server,
+// including long-lived ones such as WebSockets and server-sent events.
+func (s *Server) InFlight() int {
+	return int(s.nInFlight.Load())
+}
+
+// startRequest and endRequest keep track of the requests being handled.
+func (s *Server) startRequest() {
+	s.inFlightMu.Lock()
+	defer s.inFlightMu.Unlock()
+	if s.nInFlight.Add(1) == 1 {
+		s.idle = make(chan struct{})
+	}
+}
+
+func (s *Server) endRequest() {
+	s.inFlightMu.Lock()
+	defer s.inFlightMu.Unlock()
+	if s.nInFlight.Add(-1) == 0 {
+		close(s.idle)
+	}
+}
+
+// waitInFlight waits until there are no requests being handled,
+// or until ctx is done.
+func (s *Server) waitInFlight(ctx context.Context) error {
+	s.inFlightMu.Lock()
+	idle := s.idle
+	busy := s.nInFlight.Load() > 0
+	s.inFlightMu.Unlock()
+	if !busy {
+		return nil
+	}
+	select {
+	case <-idle:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// OnRequestComplete adds a function to be called after every request
+// handled by the Server, with information about that request.
+// This should only be called before the first call to ServeHTTP.
+func (s *Server) OnRequestComplete(f func(info RequestInfo)) {
+	s.onComplete = append(s.onComplete, f)
+}
+
+// SetSlowRequestThreshold causes fn to be called after every request
+// handled by the Server which takes longer than d, with information about it
+// (including the matched pattern and the status code).
+// It is implemented with OnRequestComplete.
+func (s *Server) SetSlowRequestThreshold(d time.Duration, fn func(info RequestInfo)) {
+	s.OnRequestComplete(func(info RequestInfo) {
+		if info.Duration > d {
+			fn(info)
+		}
+	})
 }
 
 // AddMiddleware adds a new middleware to the Server.
@@ -61,57 +330,197 @@ type contextListenAddress struct{}
 // Serve accepts incoming connections on the specified address(es)
 // and handles each connection in a goroutine.
 //
-// The addresses can have the form "network!addr" or just "addr",
-// in which case the network is inferred
-// ("unix" if the addr is a filename beginning with "/",
-// or "tcp" if the addr is "host:port").
+// The addresses can have the form "network!addr" or just "addr".
+// The network can be any of the ones supported by net.Listen,
+// like "tcp4" or "tcp6" to use only IPv4 or IPv6 (eg, "tcp6![::1]:8080").
+// If there is no network, it is "unix" if the addr is a filename
+// beginning with "/", or Server.DefaultNetwork if it is set.
+// Otherwise, it is "tcp" if the addr is "host:port".
+//
+// With a TCP network, a bare port number like "8080" is the same as ":8080".
+//
+// The address can also be a listener already open in a file descriptor,
+// like the ones passed by systemd in socket-activated services:
+// "fd!3" uses the file descriptor 3, and "systemd!0" uses the first
+// one passed by systemd (see sd_listen_fds(3)).
 //
 // Serve always returns a non-nil error.
+// After Shutdown, it returns http.ErrServerClosed once all
+// the requests have been completed.
 func (s *Server) Serve(addrs ...string) error {
+	return s.serve(nil, addrs)
+}
+
+// ServeTLS is like Serve, but it expects HTTPS connections
+// on the TCP addresses, using the certificate and private key
+// in certFile and keyFile.
+// Unix sockets remain plaintext.
+func (s *Server) ServeTLS(certFile, keyFile string, addrs ...string) error {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return fmt.Errorf("ServeTLS: %w", err)
+	}
+	return s.serve(&tls.Config{Certificates: []tls.Certificate{cert}}, addrs)
+}
+
+// listen announces on the address ad, with the syntax used in Serve.
+func (s *Server) listen(ad string) (net.Listener, error) {
+	network, addr, found := strings.Cut(ad, "!")
+	if !found {
+		addr = ad
+		if strings.HasPrefix(ad, "/") {
+			network = "unix"
+		} else if s.DefaultNetwork != "" {
+			network = s.DefaultNetwork
+		} else if strings.Contains(ad, ":") || isPort(ad) {
+			network = "tcp"
+		} else {
+			return nil, errors.New("Serve: " + ad + ": unrecognized address")
+		}
+	}
+	if network == "fd" || network == "systemd" {
+		l, err := fileListener(network, addr)
+		if err != nil {
+			return nil, fmt.Errorf("Serve: %s: %w", ad, err)
+		}
+		return l, nil
+	}
+	if strings.HasPrefix(network, "tcp") && isPort(addr) {
+		addr = ":" + addr
+	}
+	l, err := net.Listen(network, addr)
+	if err != nil {
+		return nil, fmt.Errorf("Serve: %s: %w", ad, err)
+	}
+	return l, nil
+}
+
+// sdListenFdsStart is the first file descriptor passed by systemd.
+const sdListenFdsStart = 3
+
+// fileListener returns a listener from an open file descriptor:
+// addr is the number of the descriptor with the network "fd",
+// or the index of the ones passed by systemd with the network "systemd".
+func fileListener(network, addr string) (net.Listener, error) {
+	n, err := strconv.Atoi(addr)
+	if err != nil || n < 0 {
+		return nil, errors.New("invalid file descriptor")
+	}
+	if network == "systemd" {
+		if os.Getenv("LISTEN_PID") != strconv.Itoa(os.Getpid()) {
+			return nil, errors.New("no file descriptors passed by systemd")
+		}
+		nfds, _ := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+		if n >= nfds {
+			return nil, fmt.Errorf("only %d file descriptors passed by systemd", nfds)
+		}
+		n += sdListenFdsStart
+	}
+	f := os.NewFile(uintptr(n), "fd"+strconv.Itoa(n))
+	defer f.Close()
+	return net.FileListener(f)
+}
+
+// isPort reports whether s is a port number.
+func isPort(s string) bool {
+	_, err := strconv.ParseUint(s, 10, 16)
+	return err == nil
+}
+
+func (s *Server) serve(tlsConfig *tls.Config, addrs []string) error {
 	if len(addrs) == 0 {
 		return errors.New("Serve: no addresses to listen for connections")
 	}
 	var listeners []net.Listener
+	var servers []*http.Server
 	errs := make(chan error)
 	for _, ad := range addrs {
-		network, addr, found := strings.Cut(ad, "!")
-		if !found {
-			if strings.HasPrefix(ad, "/") {
-				network = "unix"
-				addr = ad
-			} else if strings.Contains(ad, ":") {
-				network = "tcp"
-				addr = ad
-			} else {
-				for _, l := range listeners {
-					l.Close()
-				}
-				return errors.New("Serve: " + ad + ": unrecognized address")
-			}
-		}
-
-		l, err := net.Listen(network, addr)
+		l, err := s.listen(ad)
 		if err != nil {
-			for _, l = range listeners {
+			for _, l := range listeners {
 				l.Close()
 			}
 			return err
 		}
+		if tlsConfig != nil && l.Addr().Network() != "unix" {
+			l = tls.NewListener(l, tlsConfig)
+		}
 		listeners = append(listeners, l)
-		go func() {
-			errs <- http.Serve(l, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		servers = append(servers, &http.Server{
+			Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 				r2 := r.WithContext(context.WithValue(r.Context(), contextListenAddress{}, ad))
 				s.ServeHTTP(w, r2)
-			}))
+			}),
+		})
+	}
+	s.srvMu.Lock()
+	if s.inShutdown {
+		s.srvMu.Unlock()
+		for _, l := range listeners {
+			l.Close()
+		}
+		return http.ErrServerClosed
+	}
+	s.servers = append(s.servers, servers...)
+	s.srvMu.Unlock()
+	for i := range servers {
+		go func() {
+			errs <- servers[i].Serve(listeners[i])
 		}()
 	}
 	err := <-errs
 	for _, l := range listeners {
 		l.Close()
 	}
+	if errors.Is(err, http.ErrServerClosed) {
+		<-s.shutdownDone()
+	}
+	s.srvMu.Lock()
+	s.servers = slices.DeleteFunc(s.servers, func(hs *http.Server) bool {
+		return slices.Contains(servers, hs)
+	})
+	s.srvMu.Unlock()
 	return err
 }
 
+// shutdownDone returns a channel which is closed when Shutdown finishes.
+func (s *Server) shutdownDone() chan struct{} {
+	s.srvMu.Lock()
+	defer s.srvMu.Unlock()
+	if s.shutdown == nil {
+		s.shutdown = make(chan struct{})
+	}
+	return s.shutdown
+}
+
+// Shutdown gracefully shuts down the Server: it stops accepting
+// new connections in Serve, and waits until all the requests
+// in progress (including WebSockets and other hijacked connections)
+// have been completed, or until ctx is done.
+//
+// Once Shutdown has been called, the Server may not be reused.
+func (s *Server) Shutdown(ctx context.Context) error {
+	done := s.shutdownDone()
+	defer s.shutdownOnce.Do(func() { close(done) })
+
+	s.srvMu.Lock()
+	s.inShutdown = true
+	servers := slices.Clone(s.servers)
+	s.srvMu.Unlock()
+	errs := make([]error, len(servers)+1)
+	var wg sync.WaitGroup
+	for i, hs := range servers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = hs.Shutdown(ctx)
+		}()
+	}
+	wg.Wait()
+	errs[len(servers)] = s.waitInFlight(ctx)
+	return errors.Join(errs...)
+}
+
 // GetListenAddress returns the address used by Serve in the execution of this Request.
 func GetListenAddress(r *http.Request) string {
 	c := r.Context()
@@ -121,20 +530,26 @@ func GetListenAddress(r *http.Request) string {
 
 // Set assigns a value to a given key for all the requests
 // in a given server.
-// Calls to Server.Set must not be concurrent.
+// It can be called at any time, even while the Server is handling requests:
+// the requests already in progress keep the values they started with.
 func (s *Server) Set(key string, value any) {
-	if s.values == nil {
-		s.values = make(map[string]any)
+	s.valuesMu.Lock()
+	defer s.valuesMu.Unlock()
+	m := make(map[string]any)
+	if old := s.values.Load(); old != nil {
+		maps.Copy(m, *old)
 	}
-	s.values[key] = value
+	m[key] = value
+	s.values.Store(&m)
 }
 
 // Get retrieves a value from a given key in this Server.
 func (s *Server) Get(key string) any {
-	if s.values == nil {
+	m := s.values.Load()
+	if m == nil {
 		return nil
 	}
-	return s.values[key]
+	return (*m)[key]
 }
 
 // Request encapsulates a *http.Request to be able to use the Get and Set methods.
@@ -142,38 +557,101 @@ type Request struct {
 	*http.Request
 }
 
+type contextServer struct{}
+
+// requestServer returns the Server handling this request, or nil if there is none.
+func requestServer(r *http.Request) *Server {
+	if r == nil {
+		return nil
+	}
+	s, _ := r.Context().Value(contextServer{}).(*Server)
+	return s
+}
+
 // newRequest initializes a Request, adding the values previously set in the Server.
 func (s *Server) newRequest(r *http.Request) *Request {
-	req := Request{
-		Request: r,
+	values := &requestValues{m: make(map[string]any)}
+	if m := s.values.Load(); m != nil {
+		maps.Copy(values.m, *m)
 	}
-	for key, val := range s.values {
-		req.Set(key, val)
-	}
-	return &req
+	ctx := context.WithValue(r.Context(), contextServer{}, s)
+	ctx = context.WithValue(ctx, contextServerKey{}, values)
+	return &Request{Request: r.WithContext(ctx)}
 }
 
 type contextServerKey struct{}
 
+// requestValues holds the values of a Request.
+// It is stored only once in the context of the request,
+// and modified in place by Request.Set.
+type requestValues struct {
+	m map[string]any
+}
+
 // Set assigns a value to a given key for this Request.
 // Calls to Request.Set must not be concurrent.
 func (r *Request) Set(key string, value any) {
-	m, ok := r.Request.Context().Value(contextServerKey{}).(map[string]any)
+	values, ok := r.Request.Context().Value(contextServerKey{}).(*requestValues)
 	if !ok {
-		m = make(map[string]any)
+		values = &requestValues{m: make(map[string]any)}
+		r.Request = r.Request.WithContext(context.WithValue(r.Request.Context(), contextServerKey{}, values))
 	}
-	m[key] = value
-	r.Request = r.Request.WithContext(context.WithValue(r.Request.Context(), contextServerKey{}, m))
+	values.m[key] = value
 }
 
 // Get retrieves a value from a given key in this Request.
 func (r *Request) Get(key string) any {
-	c := r.Request.Context()
-	m, ok := c.Value(contextServerKey{}).(map[string]any)
+	values, ok := r.Request.Context().Value(contextServerKey{}).(*requestValues)
 	if !ok {
 		return nil
 	}
-	return m[key]
+	return values.m[key]
+}
+
+type contextCookies struct{}
+
+// SetCookie adds a Set-Cookie header to the response to this request.
+// It can be called several times to set several cookies.
+//
+// In handler functions (see Handler), the cookies are sent
+// when the function returns, along with its output.
+// Otherwise, they are added to the headers of the ResponseWriter
+// installed by the Server, if any.
+func (r *Request) SetCookie(cookie *http.Cookie) {
+	if cookies, ok := r.Context().Value(contextCookies{}).(*[]*http.Cookie); ok {
+		*cookies = append(*cookies, cookie)
+		return
+	}
+	if rw := requestResponseWriter(r.Request); rw != nil {
+		http.SetCookie(rw, cookie)
+	}
+}
+
+// Param returns the value of a wildcard in the pattern matching the request
+// (eg, "id" in "/users/{id}"), or "" if there is no such wildcard.
+// It is the same as PathValue.
+func (r *Request) Param(name string) string {
+	return r.PathValue(name)
+}
+
+// Wildcard returns the part of the path matched by a "{name...}" wildcard
+// at the end of the pattern (eg, "a/b.txt" for "/files/a/b.txt" and
+// the pattern "GET /files/{path...}"), or "" if there is no such wildcard.
+// The value is unescaped, so it can contain any character.
+func (r *Request) Wildcard(name string) string {
+	return r.PathValue(name)
+}
+
+// ParamInt returns the value of a wildcard in the pattern matching the request,
+// converted to int.  If it is not a valid integer, the error has
+// a 400 Bad Request HTTP status, so it can be returned directly by the handler.
+func (r *Request) ParamInt(name string) (int, error) {
+	v := r.PathValue(name)
+	i, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, HTTPError(http.StatusBadRequest, "invalid %s: %q is not an integer", name, v)
+	}
+	return i, nil
 }
 
 // checkHandler panics if handler is not valid.
@@ -183,36 +661,52 @@ func (r *Request) Get(key string) any {
 //   - func (http.ResponseWriter, *http.Request)
 //   - func [Input, Output any] (*Request, Input) (Output, error)
 //   - func [Output any] (*Request) (Output, error)
+//   - func [Input any] (*Request, Input) error
+//   - func (*Request) error
 func checkHandler(handler any) {
+	if err := validateHandler(handler); err != nil {
+		panic(err.Error())
+	}
+}
+
+// validateHandler returns an error if handler is not valid (see checkHandler).
+func validateHandler(handler any) error {
 	if handler == nil {
-		panic("error: nil handler")
+		return errors.New("error: nil handler")
 	}
 	if _, ok := handler.(http.Handler); ok {
-		return
+		return nil
 	}
 	t := reflect.TypeOf(handler)
 	if t == nil || t.Kind() != reflect.Func {
-		panic("handler must be a function or a http.Handler")
+		return errors.New("handler must be a function or a http.Handler")
 	}
 	if t.NumIn() < 1 || t.NumIn() > 2 {
-		panic("handler function must have 1 or 2 arguments")
+		return errors.New("handler function must have 1 or 2 arguments")
 	}
 	v := reflect.ValueOf(handler)
 	if v.IsZero() {
-		panic("handler must be a non-nil function")
+		return errors.New("handler must be a non-nil function")
 	}
 	if _, ok := handler.(func(http.ResponseWriter, *http.Request)); ok {
-		return
+		return nil
 	}
 	if t.In(0) != reflect.TypeOf(&Request{}) {
-		panic("handler: first argument of function must have type *api.Request")
+		return errors.New("handler: first argument of function must have type *api.Request")
+	}
+	if t.NumOut() == 1 {
+		if t.Out(0) != reflect.TypeOf(errors.New).Out(0) {
+			return errors.New("handler: the only return value of function must have type error")
+		}
+		return nil
 	}
 	if t.NumOut() != 2 {
-		panic("handler: function must have 2 return values")
+		return errors.New("handler: function must have 1 or 2 return values")
 	}
 	if t.Out(1) != reflect.TypeOf(errors.New).Out(0) {
-		panic("handler: second return value of function must have type error")
+		return errors.New("handler: second return value of function must have type error")
 	}
+	return nil
 }
 
 func checkPermFuncs(r *Request, permFuncs ...func(*Request) bool) bool {
@@ -228,6 +722,38 @@ func checkPermFuncs(r *Request, permFuncs ...func(*Request) bool) bool {
 	return true
 }
 
+// AllPerms returns a permission function which succeeds
+// only if all of perms succeed (or if there are none).
+//
+// The permission functions passed to Handle and Handler succeed if any
+// of them does; AllPerms and AnyPerms can be combined to build
+// more complex conditions:
+//
+//	s.Handle("/admin", handler, api.AllPerms(isAuthenticated, api.AnyPerms(isAdmin, isOwner)))
+func AllPerms(perms ...func(*Request) bool) func(*Request) bool {
+	return func(r *Request) bool {
+		for _, p := range perms {
+			if !p(r) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// AnyPerms returns a permission function which succeeds
+// if any of perms succeeds.  See AllPerms.
+func AnyPerms(perms ...func(*Request) bool) func(*Request) bool {
+	return func(r *Request) bool {
+		for _, p := range perms {
+			if p(r) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
 // handleWithPerm is a wrapper that executes the provided handler unless all the
 // permFuncs fail
 func handleWithPerm(handler http.Handler, permFuncs ...func(*Request) bool) http.Handler {
@@ -235,7 +761,7 @@ func handleWithPerm(handler http.Handler, permFuncs ...func(*Request) bool) http
 		req := &Request{r}
 
 		if !checkPermFuncs(req, permFuncs...) {
-			httpCodeError(w, http.StatusUnauthorized, "permission denied")
+			httpCodeError(w, r, http.StatusUnauthorized, "permission denied")
 			return
 		}
 
@@ -243,22 +769,177 @@ func handleWithPerm(handler http.Handler, permFuncs ...func(*Request) bool) http
 	})
 }
 
+// HandleOption configures a single route registered with Server.HandleWith.
+type HandleOption func(*route)
+
+// route holds the configuration of a route registered with Server.HandleWith.
+type route struct {
+	middlewares []func(http.Handler) http.Handler
+	permFuncs   []func(*Request) bool            // see Perms
+	methodPerms map[string][]func(*Request) bool // see Method
+	permsFirst  bool                             // see PermsFirst
+}
+
+// withMethodPerms wraps h with the permission functions added with Method, if any.
+func (rt *route) withMethodPerms(h http.Handler) http.Handler {
+	if rt.methodPerms == nil {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		perms, ok := rt.methodPerms[r.Method]
+		if !ok && r.Method == http.MethodHead {
+			perms = rt.methodPerms[http.MethodGet]
+		}
+		if !checkPermFuncs(&Request{r}, perms...) {
+			httpCodeError(w, r, http.StatusUnauthorized, "permission denied")
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// WithMiddleware is a HandleOption that wraps a single route
+// in the given middlewares, in addition to the ones added
+// to the Server with AddMiddleware.  The first one is the outermost.
+func WithMiddleware(mw ...func(http.Handler) http.Handler) HandleOption {
+	return func(rt *route) {
+		rt.middlewares = append(rt.middlewares, mw...)
+	}
+}
+
+// PermsFirst is a HandleOption that checks the permission functions
+// of a route before its middlewares (see WithMiddleware and WithRateLimit),
+// so they never see requests without permission.
+// By default, the middlewares run first.
+func PermsFirst() HandleOption {
+	return func(rt *route) {
+		rt.permsFirst = true
+	}
+}
+
+// Perms is a HandleOption with permission functions for the route,
+// like the ones passed to Handle.  At least one of them must succeed.
+func Perms(perm ...func(*Request) bool) HandleOption {
+	return func(rt *route) {
+		rt.permFuncs = append(rt.permFuncs, perm...)
+	}
+}
+
+// Method is a HandleOption with permission functions which only apply
+// to requests with method m, so a pattern can have different permissions
+// for different methods.  At least one of them must succeed.
+// The method is case-insensitive ("post" is the same as "POST").
+// HEAD requests use the permissions for GET,
+// unless there are some specific for HEAD.
+//
+// They are checked in addition to the permission functions
+// added with Perms, which apply to every method:
+//
+//	// anyone can GET, but only admins can POST:
+//	s.HandleWith("/items", handler, api.Method("POST", isAdmin))
+func Method(m string, perm ...func(*Request) bool) HandleOption {
+	return func(rt *route) {
+		if rt.methodPerms == nil {
+			rt.methodPerms = make(map[string][]func(*Request) bool)
+		}
+		m = strings.ToUpper(m)
+		rt.methodPerms[m] = append(rt.methodPerms[m], perm...)
+	}
+}
+
 // Handle registers a handler for one pattern in the server.
 //
 // The function to be called when the server receives
-// a petition matching the pattern will be Handler(handler, permFuncs...)
+// a petition matching the pattern will be Handler(handler, permFuncs...).
+// Use HandleWith to configure the route with HandleOptions.
 func (s *Server) Handle(pattern string, handler any, permFuncs ...func(*Request) bool) {
 	if s == nil {
 		panic("api.Handle: called with nil Server")
 	}
+	s.HandleWith(pattern, handler, Perms(permFuncs...))
+}
+
+// HandleWith registers a handler for one pattern in the server, like Handle,
+// configuring the route with the options:
+//
+//	s.HandleWith("POST /search", search, api.Perms(isUser), api.WithRateLimit(5, 10))
+//
+// The function to be called when the server receives
+// a petition matching the pattern will be Handler(handler, permFuncs...),
+// with the permission functions added with Perms,
+// wrapped in the middlewares added by the options, if any.
+// That is, the middlewares of the route run first, then the permission
+// functions (including the ones added with Method), then the handler.
+// Use the PermsFirst option to check the permissions before the middlewares.
+func (s *Server) HandleWith(pattern string, handler any, options ...HandleOption) {
+	if s == nil {
+		panic("api.HandleWith: called with nil Server")
+	}
 	checkHandler(handler)
+	var rt route
+	for _, opt := range options {
+		opt(&rt)
+	}
 	s.patterns = append(s.patterns, pattern)
-	s.mux.Handle(pattern, Handler(handler, permFuncs...))
+	s.handlers = append(s.handlers, handler)
+	var h http.Handler
+	if rt.permsFirst {
+		h = Handler(handler)
+	} else {
+		h = rt.withMethodPerms(Handler(handler, rt.permFuncs...))
+	}
+	for i := len(rt.middlewares) - 1; i >= 0; i-- {
+		h = rt.middlewares[i](h)
+	}
+	if rt.permsFirst {
+		h = rt.withMethodPerms(handleWithPerm(h, rt.permFuncs...))
+	}
+	s.mux.Handle(pattern, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if rw := requestResponseWriter(r); rw != nil {
+			rw.pattern = pattern
+		}
+		h.ServeHTTP(w, r)
+	}))
 	if s.debug {
 		log.Printf("Added new handler: pattern=%q func=%T", pattern, handler)
 	}
 }
 
+// Routes returns the patterns registered in the Server, in order of registration,
+// as passed to Handle (eg, "GET /users/{id}" or "/static/").
+func (s *Server) Routes() []string {
+	return slices.Clone(s.patterns)
+}
+
+// HandleStruct registers every exported method of svc which is a valid
+// handler (see Handler) in the pattern prefix + "/" + the method name,
+// with its first letter in lower case.  Other methods are skipped.
+// The options are used for all the methods, like in HandleWith.
+//
+// For example, if svc has a method
+//
+//	func (s *UserService) GetUser(r *api.Request) (*User, error)
+//
+// then HandleStruct("GET /users", svc) registers it as "GET /users/getUser".
+//
+// HandleStruct panics if svc has no handler methods.
+func (s *Server) HandleStruct(prefix string, svc any, options ...HandleOption) {
+	v := reflect.ValueOf(svc)
+	found := false
+	for i := 0; i < v.NumMethod(); i++ {
+		handler := v.Method(i).Interface()
+		if validateHandler(handler) != nil {
+			continue
+		}
+		name := v.Type().Method(i).Name
+		s.HandleWith(prefix+"/"+strings.ToLower(name[:1])+name[1:], handler, options...)
+		found = true
+	}
+	if !found {
+		panic(fmt.Sprintf("api.HandleStruct: %T has no handler methods", svc))
+	}
+}
+
 // Handler returns a http.Handler from a handler function.
 //
 // handler must be a function with one of these signatures:
@@ -266,9 +947,35 @@ func (s *Server) Handle(pattern string, handler any, permFuncs ...func(*Request)
 //   - func (http.ResponseWriter, *http.Request)
 //   - func [Input, Output any] (*Request, Input) (Output, error)
 //   - func [Output any] (*Request) (Output, error)
+//   - func [Input any] (*Request, Input) error
+//   - func (*Request) error
 //
 // If there are permFuncs, at least one of them must succeed.
 //
+// Input is decoded from the JSON request body.  If Input is a struct
+// with fields with a "query" tag (see Request.BindQuery), in GET, HEAD
+// and DELETE requests it is taken from the query parameters instead.
+//
+// If Input implements Validator, its Validate method is called
+// after decoding it, and the handler is not called if it fails:
+// the response is 422 Unprocessable Entity, unless the error
+// implements HTTPStatus.
+//
+// If the request body has a Content-Encoding, it is decompressed
+// using the decompressors available (see RegisterDecompressor).
+//
+// The cookies set by the function with Request.SetCookie are sent
+// in the response, even if it returns an error.
+//
+// If the function only returns an error and it is nil,
+// the response is 204 No Content, with no body.
+//
+// If Output is a channel, the handler waits until a value is received
+// from it and sends that value as the response (long polling).
+// If the request is cancelled before that, or the channel is closed,
+// the response has no body and its status code is the one
+// set with Server.SetLongPollStatus (204 No Content by default).
+//
 // If the error returned by the function implements HTTPStatus,
 // it is used as the HTTP Status code to be returned.
 func Handler(handler any, permFuncs ...func(*Request) bool) http.Handler {
@@ -283,64 +990,156 @@ func Handler(handler any, permFuncs ...func(*Request) bool) http.Handler {
 	v := reflect.ValueOf(handler)
 	nargs := t.NumIn()
 	var tinput reflect.Type
+	var queryInput bool // Input has fields with a "query" tag
 	if nargs == 2 {
 		tinput = t.In(1)
+		if tinput.Kind() == reflect.Struct {
+			queryFields(tinput, func(int, string, bool) { queryInput = true })
+		}
 	}
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		req := &Request{r}
+		cookies := new([]*http.Cookie)
+		req := &Request{r.WithContext(context.WithValue(r.Context(), contextCookies{}, cookies))}
 		if !checkPermFuncs(req, permFuncs...) {
-			httpCodeError(w, http.StatusUnauthorized, "permission denied")
+			httpCodeError(w, r, http.StatusUnauthorized, "permission denied")
 			return
 		}
 		var out []reflect.Value
 		if nargs == 1 {
 			out = v.Call([]reflect.Value{reflect.ValueOf(req)})
+		} else if queryInput && (r.Method == "GET" || r.Method == "HEAD" || r.Method == "DELETE") {
+			input := reflect.New(tinput)
+			if err := decodeQuery(r.URL.Query(), input.Interface()); err != nil {
+				httpError(w, r, err)
+				return
+			}
+			if err := validateInput(input.Elem()); err != nil {
+				httpError(w, r, err)
+				return
+			}
+			out = v.Call([]reflect.Value{reflect.ValueOf(req), input.Elem()})
 		} else {
 			if r.ContentLength == 0 {
-				httpError(w, "no body supplied")
+				httpError(w, r, "no body supplied")
 				return
 			}
-			decoder := json.NewDecoder(r.Body)
+			var maxBody int64
+			if s := requestServer(r); s != nil {
+				maxBody = s.maxBodySize
+			}
+			if maxBody > 0 && r.ContentLength > maxBody {
+				httpCodeError(w, r, http.StatusRequestEntityTooLarge, "request body too large")
+				return
+			}
+			body, err := requestBody(r)
+			if err != nil {
+				httpError(w, r, err)
+				return
+			}
+			defer body.Close()
+			if maxBody > 0 {
+				body = http.MaxBytesReader(w, body, maxBody)
+			}
+			decoder := json.NewDecoder(body)
 			decoder.DisallowUnknownFields()
 			input := reflect.New(tinput).Interface()
 			if err := decoder.Decode(&input); err != nil {
-				httpError(w, "parsing body: %w", err)
+				var maxErr *http.MaxBytesError
+				if errors.As(err, &maxErr) {
+					httpCodeError(w, r, http.StatusRequestEntityTooLarge, "request body too large")
+					return
+				}
+				httpError(w, r, "parsing body: %w", err)
+				return
+			}
+			if err := validateInput(reflect.ValueOf(input).Elem()); err != nil {
+				httpError(w, r, err)
 				return
 			}
 
 			out = v.Call([]reflect.Value{reflect.ValueOf(req), reflect.ValueOf(input).Elem()})
 		}
-		output := out[0].Interface()
+		for _, c := range *cookies {
+			http.SetCookie(w, c)
+		}
 		var err error
-		if e := out[1].Interface(); e != nil {
-			err = out[1].Interface().(error)
+		if e := out[len(out)-1].Interface(); e != nil {
+			err = e.(error)
 		}
 		if err != nil {
-			httpError(w, err)
+			httpError(w, r, err)
+			return
+		}
+		if len(out) == 1 {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		if out[0].Kind() == reflect.Chan && out[0].Type().ChanDir()&reflect.RecvDir != 0 {
+			waitChan(w, r, out[0])
 			return
 		}
 
-		Output(w, output)
+		outputRequest(w, r, out[0].Interface())
 	})
 }
 
-// Conn represents a Websocket connection.
-type Conn struct {
-	conn *websocket.Conn
+// validateInput calls the Validate method of the decoded input,
+// if it implements Validator.  If input is not a pointer, its address is used,
+// so Validate can have a pointer receiver.  Nil pointers are not validated.
+// Errors without a HTTP status get 422 Unprocessable Entity.
+func validateInput(input reflect.Value) error {
+	if input.Kind() == reflect.Pointer && input.IsNil() {
+		return nil
+	}
+	if input.Kind() != reflect.Pointer && input.CanAddr() {
+		input = input.Addr()
+	}
+	v, ok := input.Interface().(Validator)
+	if !ok {
+		return nil
+	}
+	err := v.Validate()
+	if err == nil {
+		return nil
+	}
+	var eh HTTPStatus
+	if errors.As(err, &eh) {
+		return err
+	}
+	return HTTPError(http.StatusUnprocessableEntity, err)
 }
 
-// Read implements the io.Reader interface: it reads data of a frame from
-// the WebSocket connection. if msg is not large enough for the frame data,
-// it fills the msg and next Read will read the rest of the frame data.
-// it reads Text frame or Binary frame.
-func (ws *Conn) Read(msg []byte) (n int, err error) {
-	return ws.conn.Read(msg)
+// waitChan waits until a value is received from ch, or the request is cancelled,
+// and sends the response.
+func waitChan(w http.ResponseWriter, r *http.Request, ch reflect.Value) {
+	chosen, v, ok := reflect.Select([]reflect.SelectCase{
+		{Dir: reflect.SelectRecv, Chan: ch},
+		{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(r.Context().Done())},
+	})
+	if chosen == 1 || !ok {
+		code := http.StatusNoContent
+		if s := requestServer(r); s != nil {
+			code = s.pollStatus
+		}
+		w.WriteHeader(code)
+		return
+	}
+	outputRequest(w, r, v.Interface())
 }
 
-// Write implements the io.Writer interface: it writes data as a frame to the
-// WebSocket connection.
-func (ws *Conn) Write(msg []byte) (n int, err error) {
-	return ws.conn.Write(msg)
+// IsWebSocket reports whether r is a request to upgrade the connection to a WebSocket.
+func IsWebSocket(r *http.Request) bool {
+	if !strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+		return false
+	}
+	for _, v := range r.Header.Values("Connection") {
+		for _, token := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return true
+			}
+		}
+	}
+	return false
 }
 
 // HandlerWS returns a handler that tries to establish a Websocket connection,
@@ -351,7 +1150,7 @@ func HandlerWS(handler func(*Request, *Conn), handlerOther any) http.Handler {
 		checkHandler(handlerOther)
 	}
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if r.Header.Get("Connection") != "Upgrade" || r.Header.Get("Upgrade") != "websocket" {
+		if !IsWebSocket(r) {
 			if handlerOther != nil {
 				Handler(handlerOther).ServeHTTP(w, r)
 				return
@@ -360,7 +1159,7 @@ func HandlerWS(handler func(*Request, *Conn), handlerOther any) http.Handler {
 			return
 		}
 		h := websocket.Server{Handler: func(ws *websocket.Conn) {
-			conn := &Conn{ws}
+			conn := &Conn{conn: ws}
 			req := &Request{r}
 			handler(req, conn)
 		}}
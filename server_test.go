@@ -1,8 +1,30 @@
 package api
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
 	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestNewServer(t *testing.T) {
@@ -44,9 +66,9 @@ func TestHandler(t *testing.T) {
 	// The first argument must be a *Request:
 	shouldPanic(func(int) (string, error) { return "", nil })
 	shouldPanic(func(string) (string, error) { return "", nil })
-	// There must be 2 return values:
-	shouldPanic(func(*Request) int { return 0 })
-	shouldPanic(func(*Request, int) int { return 0 })
+	// There must be 1 or 2 return values:
+	shouldPanic(func(*Request) {})
+	shouldPanic(func(*Request, int) {})
 	shouldPanic(func(*Request) (int, error, int) { return 0, nil, 0 })
 	shouldPanic(func(*Request, int) (int, error, int) { return 0, nil, 0 })
 	// Second return value must be error:
@@ -56,9 +78,1565 @@ func TestHandler(t *testing.T) {
 	shouldPanic(func(*Request, int) (int, string) { return 0, "" })
 	shouldPanic(func(*Request) (int, any) { return 0, nil })
 	shouldPanic(func(*Request, int) (int, any) { return 0, nil })
+	// If there is only 1 return value, it must be error:
+	shouldPanic(func(*Request) int { return 0 })
+	shouldPanic(func(*Request, int) int { return 0 })
 
 	// These should not panic:
 	shouldNotPanic(func(w http.ResponseWriter, r *http.Request) {}) // ordinary HTTP handler
 	shouldNotPanic(func(*Request, any) (any, error) { return nil, nil })
 	shouldNotPanic(func(*Request) (any, error) { return nil, nil })
+	shouldNotPanic(func(*Request, any) error { return nil })
+	shouldNotPanic(func(*Request) error { return nil })
+}
+
+func TestHandlerNoOutput(t *testing.T) {
+	s := NewServer()
+	s.Handle("DELETE /items/{id}", func(r *Request) error {
+		if r.Param("id") != "1" {
+			return HTTPError(http.StatusNotFound, "not found")
+		}
+		return nil
+	})
+	s.Handle("PUT /items/{id}", func(*Request, map[string]string) error { return nil })
+
+	for _, tc := range []struct {
+		method, path, body string
+		code               int
+	}{
+		{"DELETE", "/items/1", "", http.StatusNoContent},
+		{"DELETE", "/items/2", "", http.StatusNotFound},
+		{"PUT", "/items/1", `{"name":"x"}`, http.StatusNoContent},
+	} {
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, httptest.NewRequest(tc.method, tc.path, strings.NewReader(tc.body)))
+		if w.Code != tc.code || (tc.code == http.StatusNoContent && w.Body.Len() != 0) {
+			t.Errorf("%s %s: got %d %q, want %d", tc.method, tc.path, w.Code, w.Body.String(), tc.code)
+		}
+	}
+}
+
+func TestRecoverMiddleware(t *testing.T) {
+	for _, debug := range []bool{false, true} {
+		s := NewServer()
+		s.SetDebug(debug)
+		s.AddMiddleware(s.RecoverMiddleware)
+		s.Handle("/panic", func(*Request) (any, error) { panic("boom") })
+
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, httptest.NewRequest("GET", "/panic", nil))
+		if w.Code != http.StatusInternalServerError {
+			t.Errorf("debug=%v: got status %d, want %d", debug, w.Code, http.StatusInternalServerError)
+		}
+		var resp map[string]string
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatalf("debug=%v: decoding response: %v", debug, err)
+		}
+		if _, ok := resp["trace"]; ok != debug {
+			t.Errorf("debug=%v: trace present in response: %v", debug, ok)
+		}
+	}
+}
+
+func TestHandlerChannel(t *testing.T) {
+	s := NewServer()
+	s.Handle("/poll", func(*Request) (<-chan string, error) {
+		ch := make(chan string, 1)
+		ch <- "event"
+		return ch, nil
+	})
+	s.Handle("/never", func(*Request) (<-chan string, error) {
+		return make(chan string), nil
+	})
+
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("GET", "/poll", nil))
+	if w.Code != http.StatusOK || w.Body.String() != `{"info":"event"}`+"\n" {
+		t.Errorf("/poll: got %d %q", w.Code, w.Body.String())
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("GET", "/never", nil).WithContext(ctx))
+	if w.Code != http.StatusNoContent {
+		t.Errorf("/never: got status %d, want %d", w.Code, http.StatusNoContent)
+	}
+}
+
+func TestFormErrorEncoder(t *testing.T) {
+	s := NewServer()
+	s.SetErrorEncoder(FormErrorEncoder)
+	s.Handle("/fail", func(*Request) (any, error) {
+		return nil, HTTPError(http.StatusConflict, "already exists")
+	})
+
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("GET", "/fail", nil))
+	if w.Code != http.StatusConflict {
+		t.Errorf("got status %d, want %d", w.Code, http.StatusConflict)
+	}
+	if got, want := w.Body.String(), "error=already+exists&status=409"; got != want {
+		t.Errorf("got body %q, want %q", got, want)
+	}
+}
+
+func TestOnRequestComplete(t *testing.T) {
+	s := NewServer()
+	var info RequestInfo
+	s.OnRequestComplete(func(i RequestInfo) {
+		info = i
+	})
+	s.Handle("GET /users/{id}", func(*Request) (any, error) {
+		return nil, HTTPError(http.StatusTeapot, "teapot")
+	})
+
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("GET", "/users/42", nil))
+	if info.Method != "GET" || info.Pattern != "GET /users/{id}" || info.Status != http.StatusTeapot || info.Bytes != int64(w.Body.Len()) {
+		t.Errorf("got %+v", info)
+	}
+}
+
+func TestSetEscapeHTML(t *testing.T) {
+	for _, escape := range []bool{true, false} {
+		s := NewServer()
+		s.SetEscapeHTML(escape)
+		s.Handle("/html", func(*Request) ([]string, error) { return []string{"<b>"}, nil })
+
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, httptest.NewRequest("GET", "/html", nil))
+		want := `["<b>"]` + "\n"
+		if escape {
+			want = `["\u003cb\u003e"]` + "\n"
+		}
+		if got := w.Body.String(); got != want {
+			t.Errorf("SetEscapeHTML(%v): got %q, want %q", escape, got, want)
+		}
+	}
+}
+
+func TestHTTPOnly(t *testing.T) {
+	s := NewServer()
+	s.AddMiddleware(HTTPOnly(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("X-Middleware", "yes")
+			next.ServeHTTP(w, r)
+		})
+	}))
+	s.Handle("/", func(w http.ResponseWriter, r *http.Request) {})
+
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if w.Header().Get("X-Middleware") != "yes" {
+		t.Errorf("middleware not called for plain HTTP request")
+	}
+
+	w = httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Connection", "keep-alive, Upgrade")
+	r.Header.Set("Upgrade", "websocket")
+	s.ServeHTTP(w, r)
+	if w.Header().Get("X-Middleware") != "" {
+		t.Errorf("middleware called for WebSocket request")
+	}
+}
+
+func TestWithRateLimit(t *testing.T) {
+	s := NewServer()
+	s.HandleWith("/search", func(*Request) (string, error) { return "results", nil }, WithRateLimit(0.001, 2))
+	s.Handle("/cheap", func(*Request) (string, error) { return "ok", nil })
+
+	get := func(path string) int {
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		return w.Code
+	}
+	for i := 0; i < 5; i++ {
+		want := http.StatusOK
+		if i >= 2 {
+			want = http.StatusTooManyRequests
+		}
+		if got := get("/search"); got != want {
+			t.Errorf("/search request #%d: got status %d, want %d", i+1, got, want)
+		}
+		if got := get("/cheap"); got != http.StatusOK {
+			t.Errorf("/cheap request #%d: got status %d, want %d", i+1, got, http.StatusOK)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("GET", "/search", nil))
+	var body struct {
+		Error      string `json:"error"`
+		RetryAfter int    `json:"retry_after"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatalf("429 body %q: %v", w.Body.String(), err)
+	}
+	if body.Error != "rate limited" || body.RetryAfter < 1 ||
+		w.Header().Get("Retry-After") != strconv.Itoa(body.RetryAfter) {
+		t.Errorf("429: got Retry-After %q and body %q", w.Header().Get("Retry-After"), w.Body.String())
+	}
+}
+
+func TestWithRateLimitPerRoute(t *testing.T) {
+	s := NewServer()
+	limit := WithRateLimit(0.001, 1)
+	s.HandleWith("/a", func(*Request) (string, error) { return "a", nil }, limit)
+	s.HandleWith("/b", func(*Request) (string, error) { return "b", nil }, limit)
+
+	for _, tc := range []struct {
+		path string
+		code int
+	}{
+		{"/a", http.StatusOK},
+		{"/b", http.StatusOK},
+		{"/a", http.StatusTooManyRequests},
+		{"/b", http.StatusTooManyRequests},
+	} {
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, httptest.NewRequest("GET", tc.path, nil))
+		if w.Code != tc.code {
+			t.Errorf("%s: got status %d, want %d", tc.path, w.Code, tc.code)
+		}
+	}
+}
+
+func TestHandlerCompressedBody(t *testing.T) {
+	s := NewServer()
+	s.Handle("POST /echo", func(_ *Request, in map[string]string) (map[string]string, error) {
+		return in, nil
+	})
+
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write([]byte(`{"a":"b"}`))
+	zw.Close()
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/echo", &buf)
+	r.Header.Set("Content-Encoding", "gzip")
+	s.ServeHTTP(w, r)
+	if w.Code != http.StatusOK || w.Body.String() != `{"a":"b"}`+"\n" {
+		t.Errorf("gzip body: got %d %q", w.Code, w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest("POST", "/echo", strings.NewReader("xxx"))
+	r.Header.Set("Content-Encoding", "unknown")
+	s.ServeHTTP(w, r)
+	if w.Code != http.StatusUnsupportedMediaType {
+		t.Errorf("unknown encoding: got status %d, want %d", w.Code, http.StatusUnsupportedMediaType)
+	}
+}
+
+func TestOutputCSV(t *testing.T) {
+	type user struct {
+		ID     int    `json:"id"`
+		Name   string `csv:"full_name"`
+		Secret string `json:"-"`
+	}
+	s := NewServer()
+	s.Handle("/users", func(*Request) ([]user, error) {
+		return []user{{1, "Ann", "x"}, {2, "Bob, Jr.", "y"}}, nil
+	})
+	s.Handle("/user", func(*Request) (user, error) {
+		return user{1, "Ann", "x"}, nil
+	})
+
+	get := func(path, accept string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", path, nil)
+		r.Header.Set("Accept", accept)
+		s.ServeHTTP(w, r)
+		return w
+	}
+	w := get("/users", "text/csv")
+	want := "id,full_name\n1,Ann\n2,\"Bob, Jr.\"\n"
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "text/csv" || w.Body.String() != want {
+		t.Errorf("/users as CSV: got %d %q %q", w.Code, w.Header().Get("Content-Type"), w.Body.String())
+	}
+	if w := get("/users", "application/json, text/csv;q=0.5"); w.Header().Get("Content-Type") != "application/json" {
+		t.Errorf("/users: got Content-Type %q, want JSON", w.Header().Get("Content-Type"))
+	}
+	if w := get("/user", "text/csv"); w.Code != http.StatusNotAcceptable {
+		t.Errorf("/user as CSV: got status %d, want %d", w.Code, http.StatusNotAcceptable)
+	}
+}
+
+func TestAutoOptions(t *testing.T) {
+	s := NewServer()
+	s.SetAutoOptions(true)
+	s.Handle("GET /items", func(*Request) (string, error) { return "items", nil })
+	s.Handle("POST /items", func(*Request) (string, error) { return "created", nil })
+	s.Handle("GET /caps", func(*Request) (string, error) { return "caps", nil })
+	s.Handle("OPTIONS /caps", func(*Request) (string, error) { return "capabilities", nil })
+
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("OPTIONS", "/items", nil))
+	if w.Code != http.StatusNoContent || w.Header().Get("Allow") != "GET, HEAD, POST, OPTIONS" {
+		t.Errorf("auto OPTIONS: got %d, Allow %q", w.Code, w.Header().Get("Allow"))
+	}
+
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("OPTIONS", "/caps", nil))
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "capabilities") {
+		t.Errorf("explicit OPTIONS: got %d %q", w.Code, w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("OPTIONS", "/unknown", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("OPTIONS for unknown path: got status %d, want %d", w.Code, http.StatusNotFound)
+	}
+}
+
+func TestHandlerSSE(t *testing.T) {
+	s := NewServer()
+	s.Handle("/job", HandlerSSE(func(r *Request, sse *SSEWriter) error {
+		for i := 1; i <= 2; i++ {
+			if err := sse.Progress(map[string]int{"step": i}); err != nil {
+				return err
+			}
+		}
+		return sse.Close("finished")
+	}))
+
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("GET", "/job", nil))
+	want := "event: progress\ndata: {\"step\":1}\n\n" +
+		"event: progress\ndata: {\"step\":2}\n\n" +
+		"event: done\ndata: finished\n\n"
+	if w.Header().Get("Content-Type") != "text/event-stream" || w.Body.String() != want {
+		t.Errorf("got %q %q", w.Header().Get("Content-Type"), w.Body.String())
+	}
+}
+
+func TestHandlerSSEDisconnect(t *testing.T) {
+	updates := make(chan int)
+	sent := make(chan struct{})
+	returned := make(chan error, 1)
+	h := HandlerSSE(func(r *Request, sse *SSEWriter) error {
+		for {
+			select {
+			case n := <-updates:
+				sse.Progress(n)
+				close(sent)
+			case <-sse.Done():
+				returned <- sse.Progress("late")
+				return nil
+			}
+		}
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	w := httptest.NewRecorder()
+	done := make(chan struct{})
+	go func() {
+		h.ServeHTTP(w, httptest.NewRequest("GET", "/events", nil).WithContext(ctx))
+		close(done)
+	}()
+	updates <- 1
+	<-sent
+	cancel()
+	<-done
+	if err := <-returned; !errors.Is(err, context.Canceled) {
+		t.Errorf("Progress after disconnecting: got %v, want %v", err, context.Canceled)
+	}
+	if want := "event: progress\ndata: 1\n\n"; w.Body.String() != want {
+		t.Errorf("got %q, want %q", w.Body.String(), want)
+	}
+}
+
+func TestInFlight(t *testing.T) {
+	s := NewServer()
+	started, release := make(chan struct{}), make(chan struct{})
+	s.Handle("/slow", func(*Request) (string, error) {
+		close(started)
+		<-release
+		return "done", nil
+	})
+
+	finished := make(chan struct{})
+	go func() {
+		s.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/slow", nil))
+		close(finished)
+	}()
+	<-started
+	if n := s.InFlight(); n != 1 {
+		t.Errorf("InFlight() = %d while handling a request, want 1", n)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := s.waitInFlight(ctx); err == nil {
+		t.Errorf("waitInFlight returned before the request finished")
+	}
+	close(release)
+	<-finished
+	if n := s.InFlight(); n != 0 {
+		t.Errorf("InFlight() = %d after the request, want 0", n)
+	}
+	if err := s.waitInFlight(context.Background()); err != nil {
+		t.Errorf("waitInFlight: %v", err)
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	s := NewServer()
+	started, release := make(chan struct{}), make(chan struct{})
+	s.Handle("/slow", func(*Request) (map[string]string, error) {
+		close(started)
+		<-release
+		return map[string]string{"status": "done"}, nil
+	})
+	sock := filepath.Join(t.TempDir(), "api.sock")
+	served := make(chan error, 1)
+	go func() {
+		served <- s.Serve(sock)
+	}()
+	for i := 0; ; i++ {
+		if _, err := os.Stat(sock); err == nil {
+			break
+		} else if i == 1000 {
+			t.Fatal(err)
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	c := NewClient("http://localhost").WithUnixSocket(sock)
+	got := make(chan error, 1)
+	var out map[string]string
+	go func() {
+		got <- c.Get("/slow", &out)
+	}()
+	select {
+	case <-started:
+	case err := <-got:
+		t.Fatalf("Get: %v", err)
+	}
+
+	shutdown := make(chan error, 1)
+	go func() {
+		shutdown <- s.Shutdown(context.Background())
+	}()
+	select {
+	case err := <-served:
+		t.Fatalf("Serve returned with a request in flight: %v", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+	close(release)
+	if err := <-got; err != nil || out["status"] != "done" {
+		t.Errorf("in-flight request: got %v, %v", out, err)
+	}
+	if err := <-shutdown; err != nil {
+		t.Errorf("Shutdown: %v", err)
+	}
+	if err := <-served; !errors.Is(err, http.ErrServerClosed) {
+		t.Errorf("Serve returned %v, want %v", err, http.ErrServerClosed)
+	}
+}
+
+func TestServeTLS(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600)
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	s := NewServer()
+	s.Handle("/hello", func(*Request) (map[string]string, error) {
+		return map[string]string{"hello": "world"}, nil
+	})
+	go s.ServeTLS(certFile, keyFile, addr)
+	defer s.Shutdown(context.Background())
+
+	pool := x509.NewCertPool()
+	cert, _ := x509.ParseCertificate(der)
+	pool.AddCert(cert)
+	c := NewClient("https://" + addr).WithHTTPClient(&http.Client{
+		Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}},
+	})
+	var out map[string]string
+	for i := 0; ; i++ {
+		err = c.Get("/hello", &out)
+		if err == nil || i == 1000 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if err != nil || out["hello"] != "world" {
+		t.Errorf("got %v, %v", out, err)
+	}
+
+	if err := NewServer().ServeTLS(filepath.Join(dir, "none"), keyFile, addr); err == nil {
+		t.Errorf("ServeTLS with a missing certificate did not fail")
+	}
+}
+
+func TestSetNotFound(t *testing.T) {
+	s := NewServer()
+	s.Set("suggestion", "/hello")
+	s.AddMiddleware(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("X-Middleware", "yes")
+			next.ServeHTTP(w, r)
+		})
+	})
+	s.Handle("GET /hello", func(*Request) (map[string]string, error) {
+		return map[string]string{"hello": "world"}, nil
+	})
+	s.SetNotFound(func(r *Request) (map[string]any, error) {
+		return map[string]any{"error": "not found", "try": r.Get("suggestion")}, nil
+	})
+
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("GET", "/nothing", nil))
+	if w.Code != http.StatusNotFound || w.Header().Get("X-Middleware") != "yes" ||
+		strings.TrimSpace(w.Body.String()) != `{"error":"not found","try":"/hello"}` {
+		t.Errorf("got %d %q %q", w.Code, w.Header().Get("X-Middleware"), w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("POST", "/hello", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("POST /hello: got %d, want %d", w.Code, http.StatusMethodNotAllowed)
+	}
+}
+
+func TestCORS(t *testing.T) {
+	s := NewServer()
+	s.AddMiddleware(CORS(CORSOptions{
+		AllowedOrigins:   []string{"https://example.com"},
+		AllowCredentials: true,
+		MaxAge:           time.Hour,
+	}))
+	s.Handle("POST /items", func(*Request) (map[string]int, error) {
+		return map[string]int{"id": 1}, nil
+	})
+
+	r := httptest.NewRequest("OPTIONS", "/items", nil)
+	r.Header.Set("Origin", "https://example.com")
+	r.Header.Set("Access-Control-Request-Method", "POST")
+	r.Header.Set("Access-Control-Request-Headers", "Content-Type")
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+	if w.Code != http.StatusNoContent ||
+		w.Header().Get("Access-Control-Allow-Origin") != "https://example.com" ||
+		w.Header().Get("Access-Control-Allow-Credentials") != "true" ||
+		w.Header().Get("Access-Control-Allow-Headers") != "Content-Type" ||
+		w.Header().Get("Access-Control-Max-Age") != "3600" {
+		t.Errorf("preflight: got %d %v", w.Code, w.Header())
+	}
+
+	r = httptest.NewRequest("POST", "/items", nil)
+	r.Header.Set("Origin", "https://evil.example")
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+	if w.Code != http.StatusOK || w.Header().Get("Access-Control-Allow-Origin") != "" {
+		t.Errorf("other origin: got %d %v", w.Code, w.Header())
+	}
+}
+
+func TestRequestParam(t *testing.T) {
+	s := NewServer()
+	s.Handle("GET /users/{name}/items/{id}", func(r *Request) (map[string]any, error) {
+		id, err := r.ParamInt("id")
+		if err != nil {
+			return nil, err
+		}
+		return map[string]any{"name": r.Param("name"), "id": id}, nil
+	})
+
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("GET", "/users/bob/items/42", nil))
+	if strings.TrimSpace(w.Body.String()) != `{"id":42,"name":"bob"}` {
+		t.Errorf("got %d %q", w.Code, w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("GET", "/users/bob/items/x", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("invalid id: got %d %q, want %d", w.Code, w.Body.String(), http.StatusBadRequest)
+	}
+}
+
+func TestRequestBindQuery(t *testing.T) {
+	type params struct {
+		Page  int      `query:"page"`
+		Tags  []string `query:"tag"`
+		Draft bool     `query:"draft"`
+		Limit *uint    `query:"limit"`
+		Sort  string   `query:"sort"`
+	}
+	s := NewServer()
+	s.Handle("GET /items", func(r *Request) (params, error) {
+		p := params{Sort: "name"}
+		err := r.BindQuery(&p)
+		return p, err
+	})
+
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("GET", "/items?page=2&tag=a&tag=b&draft=true&limit=10", nil))
+	want := `{"Page":2,"Tags":["a","b"],"Draft":true,"Limit":10,"Sort":"name"}`
+	if strings.TrimSpace(w.Body.String()) != want {
+		t.Errorf("got %d %q, want %q", w.Code, w.Body.String(), want)
+	}
+
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("GET", "/items?page=two", nil))
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "page") {
+		t.Errorf("invalid page: got %d %q, want %d", w.Code, w.Body.String(), http.StatusBadRequest)
+	}
+}
+
+func TestHTTPErrorWithHeaders(t *testing.T) {
+	s := NewServer()
+	s.Handle("/private", func(*Request) (string, error) {
+		return "", HTTPErrorWithHeaders(http.StatusUnauthorized,
+			http.Header{"Www-Authenticate": {`Bearer realm="api"`}}, "token required")
+	})
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("GET", "/private", nil))
+	if w.Code != http.StatusUnauthorized || w.Header().Get("WWW-Authenticate") != `Bearer realm="api"` ||
+		strings.TrimSpace(w.Body.String()) != `{"error":"token required"}` {
+		t.Errorf("got %d %v %q", w.Code, w.Header(), w.Body.String())
+	}
+}
+
+func TestHandlerQueryInput(t *testing.T) {
+	type search struct {
+		Q     string `query:"q" json:"q"`
+		Limit int    `query:"limit" json:"limit"`
+	}
+	s := NewServer()
+	s.Handle("/search", func(_ *Request, in search) (search, error) {
+		return in, nil
+	})
+
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("GET", "/search?q=go&limit=5", nil))
+	if strings.TrimSpace(w.Body.String()) != `{"q":"go","limit":5}` {
+		t.Errorf("GET: got %d %q", w.Code, w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("POST", "/search?q=ignored", strings.NewReader(`{"q":"body"}`)))
+	if strings.TrimSpace(w.Body.String()) != `{"q":"body","limit":0}` {
+		t.Errorf("POST: got %d %q", w.Code, w.Body.String())
+	}
+}
+
+func TestSetMaxBodySize(t *testing.T) {
+	s := NewServer()
+	s.SetMaxBodySize(16)
+	s.Handle("/echo", func(_ *Request, in map[string]string) (map[string]string, error) {
+		return in, nil
+	})
+	for _, tc := range []struct {
+		body          string
+		contentLength bool
+		want          int
+	}{
+		{`{"a":"b"}`, true, http.StatusOK},
+		{`{"a":"0123456789abcdef"}`, true, http.StatusRequestEntityTooLarge},
+		{`{"a":"0123456789abcdef"}`, false, http.StatusRequestEntityTooLarge},
+	} {
+		r := httptest.NewRequest("POST", "/echo", strings.NewReader(tc.body))
+		if !tc.contentLength {
+			r.ContentLength = -1
+		}
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		if w.Code != tc.want {
+			t.Errorf("body %q: got %d %q, want %d", tc.body, w.Code, w.Body.String(), tc.want)
+		}
+	}
+}
+
+func TestRegisterEncoder(t *testing.T) {
+	s := NewServer()
+	s.RegisterEncoder("text/plain", func(w io.Writer, v any) error {
+		_, err := fmt.Fprintln(w, v)
+		return err
+	})
+	s.Handle("/items", func(*Request) ([]int, error) { return []int{1, 2}, nil })
+
+	for _, tc := range []struct{ accept, contentType, body string }{
+		{"text/plain", "text/plain", "[1 2]"},
+		{"application/xml, text/plain;q=0.5", "text/plain", "[1 2]"},
+		{"", "application/json", "[1,2]"},
+		{"application/json, text/plain;q=0.9", "application/json", "[1,2]"},
+	} {
+		r := httptest.NewRequest("GET", "/items", nil)
+		if tc.accept != "" {
+			r.Header.Set("Accept", tc.accept)
+		}
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		if w.Header().Get("Content-Type") != tc.contentType || strings.TrimSpace(w.Body.String()) != tc.body {
+			t.Errorf("Accept %q: got %q %q", tc.accept, w.Header().Get("Content-Type"), w.Body.String())
+		}
+	}
+}
+
+type testUserService struct {
+	prefix string
+}
+
+func (s *testUserService) GetUser(r *Request) (map[string]string, error) {
+	return map[string]string{"name": s.prefix + r.URL.Query().Get("id")}, nil
+}
+
+func (s *testUserService) CreateUser(_ *Request, in map[string]string) (map[string]string, error) {
+	return map[string]string{"created": s.prefix + in["name"]}, nil
+}
+
+func (s *testUserService) Close() error { return nil }
+
+func TestHandleStruct(t *testing.T) {
+	s := NewServer()
+	s.HandleStruct("/users", &testUserService{prefix: "user-"})
+
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("GET", "/users/getUser?id=1", nil))
+	if strings.TrimSpace(w.Body.String()) != `{"name":"user-1"}` {
+		t.Errorf("getUser: got %d %q", w.Code, w.Body.String())
+	}
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("POST", "/users/createUser", strings.NewReader(`{"name":"bob"}`)))
+	if strings.TrimSpace(w.Body.String()) != `{"created":"user-bob"}` {
+		t.Errorf("createUser: got %d %q", w.Code, w.Body.String())
+	}
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("GET", "/users/close", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("close: got %d, want %d", w.Code, http.StatusNotFound)
+	}
+}
+
+func TestSetJSONOptions(t *testing.T) {
+	s := NewServer()
+	s.SetJSONOptions(JSONOptions{Indent: "  ", NoEscapeHTML: true})
+	s.Handle("/item", func(*Request) (map[string]string, error) {
+		return map[string]string{"name": "<b>"}, nil
+	})
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("GET", "/item", nil))
+	want := "{\n  \"name\": \"<b>\"\n}\n"
+	if got := w.Body.String(); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestRequestWildcard(t *testing.T) {
+	s := NewServer()
+	s.Handle("GET /files/{rest...}", func(r *Request) ([]string, error) {
+		return []string{r.Wildcard("rest")}, nil
+	})
+	s.Handle("PUT /files/{rest...}", func(r *Request, in map[string]int) ([]any, error) {
+		return []any{r.Wildcard("rest"), in["size"]}, nil
+	})
+
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("GET", "/files/docs/a%20b.txt", nil))
+	if strings.TrimSpace(w.Body.String()) != `["docs/a b.txt"]` {
+		t.Errorf("GET: got %d %q", w.Code, w.Body.String())
+	}
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("PUT", "/files/x/y", strings.NewReader(`{"size":3}`)))
+	if strings.TrimSpace(w.Body.String()) != `["x/y",3]` {
+		t.Errorf("PUT: got %d %q", w.Code, w.Body.String())
+	}
+}
+
+type testSignup struct {
+	Email string `json:"email"`
+}
+
+func (s testSignup) Validate() error {
+	if !strings.Contains(s.Email, "@") {
+		return errors.New("invalid email")
+	}
+	return nil
+}
+
+func TestHandlerValidateInput(t *testing.T) {
+	s := NewServer()
+	s.Handle("POST /signup", func(_ *Request, in testSignup) (string, error) {
+		return "welcome " + in.Email, nil
+	})
+	for _, tc := range []struct {
+		body string
+		code int
+	}{
+		{`{"email":"a@example.com"}`, http.StatusOK},
+		{`{"email":"nobody"}`, http.StatusUnprocessableEntity},
+	} {
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, httptest.NewRequest("POST", "/signup", strings.NewReader(tc.body)))
+		if w.Code != tc.code {
+			t.Errorf("%s: got %d %q, want %d", tc.body, w.Code, w.Body.String(), tc.code)
+		}
+	}
+}
+
+type testSignupPtr struct {
+	Email string `json:"email"`
+}
+
+func (s *testSignupPtr) Validate() error {
+	if !strings.Contains(s.Email, "@") {
+		return errors.New("invalid email")
+	}
+	return nil
+}
+
+func TestHandlerValidatePointerInput(t *testing.T) {
+	s := NewServer()
+	s.Handle("POST /value", func(_ *Request, in testSignupPtr) (string, error) {
+		return "welcome " + in.Email, nil
+	})
+	s.Handle("POST /pointer", func(_ *Request, in *testSignupPtr) (string, error) {
+		return "welcome " + in.Email, nil
+	})
+	for _, path := range []string{"/value", "/pointer"} {
+		for _, tc := range []struct {
+			body string
+			code int
+		}{
+			{`{"email":"a@example.com"}`, http.StatusOK},
+			{`{"email":"nobody"}`, http.StatusUnprocessableEntity},
+		} {
+			w := httptest.NewRecorder()
+			s.ServeHTTP(w, httptest.NewRequest("POST", path, strings.NewReader(tc.body)))
+			if w.Code != tc.code {
+				t.Errorf("%s %s: got %d %q, want %d", path, tc.body, w.Code, w.Body.String(), tc.code)
+			}
+		}
+	}
+}
+
+func TestRoutes(t *testing.T) {
+	s := NewServer()
+	s.Handle("GET /users/{id}", func(*Request) (string, error) { return "", nil })
+	s.Handle("/static/", http.NotFoundHandler())
+	if got := fmt.Sprint(s.Routes()); got != "[GET /users/{id} /static/]" {
+		t.Errorf("Routes() = %s", got)
+	}
+}
+
+func BenchmarkSetMarshaler(b *testing.B) {
+	type item struct {
+		ID   int    `json:"id"`
+		Name string `json:"name"`
+	}
+	items := make([]item, 100)
+	for i := range items {
+		items[i] = item{ID: i, Name: fmt.Sprintf("item %d", i)}
+	}
+	for _, custom := range []bool{false, true} {
+		b.Run(fmt.Sprintf("custom=%v", custom), func(b *testing.B) {
+			s := NewServer()
+			calls := 0
+			if custom {
+				s.SetMarshaler(func(w io.Writer, v any) error {
+					calls++
+					return json.NewEncoder(w).Encode(v)
+				})
+			}
+			s.Handle("/items", func(*Request) ([]item, error) { return items, nil })
+			r := httptest.NewRequest("GET", "/items", nil)
+			for i := 0; i < b.N; i++ {
+				s.ServeHTTP(httptest.NewRecorder(), r)
+			}
+			if custom && calls == 0 {
+				b.Fatal("the marshaler set with SetMarshaler was not used")
+			}
+		})
+	}
+}
+
+func TestOpenAPI(t *testing.T) {
+	type user struct {
+		ID      int       `json:"id"`
+		Name    string    `json:"name,omitempty"`
+		Created time.Time `json:"created"`
+		secret  string
+	}
+	s := NewServer()
+	s.Handle("GET /users/{id}", func(*Request) (*user, error) { return nil, nil })
+	s.Handle("POST /users", func(*Request, user) ([]user, error) { return nil, nil })
+	s.Handle("/files/{path...}", http.NotFoundHandler())
+	s.Handle("GET /search", func(*Request, struct {
+		Q string `query:"q"`
+	}) ([]user, error) {
+		return nil, nil
+	})
+
+	b, err := s.OpenAPI()
+	if err != nil {
+		t.Fatalf("OpenAPI: %v", err)
+	}
+	var doc struct {
+		Paths      map[string]map[string]json.RawMessage
+		Components struct {
+			Schemas map[string]struct {
+				Properties map[string]struct{ Type, Format string }
+			}
+		}
+	}
+	if err := json.Unmarshal(b, &doc); err != nil {
+		t.Fatalf("OpenAPI returned invalid JSON: %v", err)
+	}
+	for _, op := range []string{"/users/{id} get", "/users post", "/files/{path} get"} {
+		path, method, _ := strings.Cut(op, " ")
+		if _, ok := doc.Paths[path][method]; !ok {
+			t.Errorf("missing operation %q in %s", op, b)
+		}
+	}
+	if strings.Contains(string(doc.Paths["/search"]["get"]), "requestBody") ||
+		!strings.Contains(string(doc.Paths["/search"]["get"]), `"in": "query"`) {
+		t.Errorf("GET /search: input not in the query: %s", doc.Paths["/search"]["get"])
+	}
+	props := doc.Components.Schemas["user"].Properties
+	if len(props) != 3 || props["id"].Type != "integer" || props["created"].Format != "date-time" {
+		t.Errorf("got schema %+v for user", props)
+	}
+}
+
+func TestSetSlowRequestThreshold(t *testing.T) {
+	s := NewServer()
+	var slow []RequestInfo
+	s.SetSlowRequestThreshold(10*time.Millisecond, func(info RequestInfo) {
+		slow = append(slow, info)
+	})
+	s.Handle("GET /fast", func(*Request) (string, error) { return "ok", nil })
+	s.Handle("GET /slow/{id}", func(*Request) (string, error) {
+		time.Sleep(20 * time.Millisecond)
+		return "ok", nil
+	})
+	s.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/fast", nil))
+	s.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/slow/1", nil))
+	if len(slow) != 1 || slow[0].Pattern != "GET /slow/{id}" || slow[0].Status != http.StatusOK {
+		t.Errorf("got %+v", slow)
+	}
+}
+
+func TestMethodPerms(t *testing.T) {
+	isAdmin := func(r *Request) bool { return r.Header.Get("X-Admin") == "yes" }
+	isEditor := func(r *Request) bool { return r.Header.Get("X-Editor") == "yes" }
+	s := NewServer()
+	s.HandleWith("/items", func(*Request) (string, error) { return "ok", nil },
+		Method("POST", isAdmin, isEditor), Method("delete", isAdmin))
+	s.HandleWith("/private", func(*Request) (string, error) { return "ok", nil },
+		Method("GET", isAdmin))
+	s.HandleWith("/public", func(*Request) (string, error) { return "ok", nil },
+		Method("GET", isAdmin), Method("HEAD"))
+
+	for _, tc := range []struct {
+		method, header string
+		code           int
+	}{
+		{"GET", "", http.StatusOK},
+		{"POST", "", http.StatusUnauthorized},
+		{"POST", "X-Editor", http.StatusOK},
+		{"DELETE", "X-Editor", http.StatusUnauthorized},
+		{"DELETE", "X-Admin", http.StatusOK},
+		{"GET /private", "", http.StatusUnauthorized},
+		{"HEAD /private", "", http.StatusUnauthorized},
+		{"HEAD /private", "X-Admin", http.StatusOK},
+		{"HEAD /public", "", http.StatusOK},
+	} {
+		method, path, ok := strings.Cut(tc.method, " ")
+		if !ok {
+			path = "/items"
+		}
+		r := httptest.NewRequest(method, path, nil)
+		if tc.header != "" {
+			r.Header.Set(tc.header, "yes")
+		}
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		if w.Code != tc.code {
+			t.Errorf("%s with %q: got %d, want %d", tc.method, tc.header, w.Code, tc.code)
+		}
+	}
+}
+
+func TestDumpMiddleware(t *testing.T) {
+	var dump bytes.Buffer
+	s := NewServer()
+	s.AddMiddleware(DumpMiddleware(&dump))
+	s.Handle("POST /echo", func(_ *Request, in map[string]string) (map[string]string, error) {
+		return in, nil
+	})
+
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("POST", "/echo", strings.NewReader(`{"a":"b"}`)))
+	if strings.TrimSpace(w.Body.String()) != `{"a":"b"}` {
+		t.Errorf("the handler got %d %q", w.Code, w.Body.String())
+	}
+	for _, want := range []string{"POST /echo HTTP/1.1\r\n", `{"a":"b"}` + "\n\nHTTP/1.1 200 OK\r\n", "Content-Type: application/json\r\n"} {
+		if !strings.Contains(dump.String(), want) {
+			t.Errorf("dump does not contain %q:\n%s", want, dump.String())
+		}
+	}
+}
+
+func TestAllAnyPerms(t *testing.T) {
+	header := func(name string) func(*Request) bool {
+		return func(r *Request) bool { return r.Header.Get(name) != "" }
+	}
+	perm := AllPerms(header("X-User"), AnyPerms(header("X-Admin"), header("X-Owner")))
+	for _, tc := range []struct {
+		headers []string
+		want    bool
+	}{
+		{nil, false},
+		{[]string{"X-User"}, false},
+		{[]string{"X-Admin"}, false},
+		{[]string{"X-User", "X-Owner"}, true},
+		{[]string{"X-User", "X-Admin", "X-Owner"}, true},
+	} {
+		r := httptest.NewRequest("GET", "/", nil)
+		for _, h := range tc.headers {
+			r.Header.Set(h, "1")
+		}
+		if got := perm(&Request{r}); got != tc.want {
+			t.Errorf("headers %v: got %v, want %v", tc.headers, got, tc.want)
+		}
+	}
+	if !AllPerms()(&Request{httptest.NewRequest("GET", "/", nil)}) {
+		t.Errorf("AllPerms() with no functions failed")
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	s := NewServer()
+	s.AddMiddleware(RateLimit(0.001, 1, func(r *Request) string {
+		return r.Header.Get("X-User")
+	}))
+	s.Handle("/items", func(*Request) (string, error) { return "ok", nil })
+
+	get := func(user string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "/items", nil)
+		r.Header.Set("X-User", user)
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		return w
+	}
+	if w := get("alice"); w.Code != http.StatusOK {
+		t.Errorf("first request: got %d, want %d", w.Code, http.StatusOK)
+	}
+	if w := get("alice"); w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") == "" {
+		t.Errorf("second request: got %d with Retry-After %q, want %d", w.Code, w.Header().Get("Retry-After"), http.StatusTooManyRequests)
+	}
+	if w := get("bob"); w.Code != http.StatusOK {
+		t.Errorf("request from another user: got %d, want %d", w.Code, http.StatusOK)
+	}
+}
+
+func TestRequestStatus(t *testing.T) {
+	s := NewServer()
+	var status, size int
+	s.AddMiddleware(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			next.ServeHTTP(w, r)
+			req := &Request{r}
+			status, size = req.Status(), req.BytesWritten()
+		})
+	})
+	s.Handle("/teapot", func(*Request) (string, error) {
+		return "", HTTPError(http.StatusTeapot, "short and stout")
+	})
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("GET", "/teapot", nil))
+	if status != http.StatusTeapot || size != w.Body.Len() {
+		t.Errorf("got status %d and %d bytes, want %d and %d", status, size, http.StatusTeapot, w.Body.Len())
+	}
+}
+
+func TestTimeoutMiddleware(t *testing.T) {
+	s := NewServer()
+	s.AddMiddleware(TimeoutMiddleware(20 * time.Millisecond))
+	s.Handle("/fast", func(*Request) (string, error) { return "ok", nil })
+	s.Handle("/slow", func(r *Request) (string, error) {
+		select {
+		case <-time.After(time.Second):
+			return "too late", nil
+		case <-r.Context().Done():
+			return "", r.Context().Err()
+		}
+	})
+
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("GET", "/fast", nil))
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "ok") {
+		t.Errorf("/fast: got %d %q", w.Code, w.Body.String())
+	}
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("GET", "/slow", nil))
+	if w.Code != http.StatusServiceUnavailable || w.Header().Get("Content-Type") != "application/json" {
+		t.Errorf("/slow: got %d with Content-Type %q, want %d", w.Code, w.Header().Get("Content-Type"), http.StatusServiceUnavailable)
+	}
+}
+
+func TestRequestSetCookie(t *testing.T) {
+	s := NewServer()
+	s.Handle("POST /login", func(r *Request) (string, error) {
+		r.SetCookie(&http.Cookie{Name: "session", Value: "abc123", HttpOnly: true})
+		r.SetCookie(&http.Cookie{Name: "lang", Value: "es"})
+		return "welcome", nil
+	})
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("POST", "/login", nil))
+	cookies := w.Result().Cookies()
+	if len(cookies) != 2 || cookies[0].Name != "session" || cookies[0].Value != "abc123" || !cookies[0].HttpOnly || cookies[1].Name != "lang" {
+		t.Errorf("got cookies %v", cookies)
+	}
+}
+
+func TestHandlePermsOrder(t *testing.T) {
+	var calls []string
+	mw := func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			calls = append(calls, "middleware")
+			next.ServeHTTP(w, r)
+		})
+	}
+	perm := func(r *Request) bool {
+		calls = append(calls, "perm")
+		return r.Header.Get("X-Admin") != ""
+	}
+	handler := func(*Request) (string, error) {
+		calls = append(calls, "handler")
+		return "ok", nil
+	}
+	s := NewServer()
+	s.HandleWith("/default", handler, Perms(perm), WithMiddleware(mw))
+	s.HandleWith("/first", handler, Perms(perm), WithMiddleware(mw), PermsFirst())
+
+	tests := []struct {
+		path  string
+		admin bool
+		want  string
+	}{
+		{"/default", true, "[middleware perm handler]"},
+		{"/default", false, "[middleware perm]"},
+		{"/first", true, "[perm middleware handler]"},
+		{"/first", false, "[perm]"},
+	}
+	for _, test := range tests {
+		calls = nil
+		r := httptest.NewRequest("GET", test.path, nil)
+		if test.admin {
+			r.Header.Set("X-Admin", "1")
+		}
+		s.ServeHTTP(httptest.NewRecorder(), r)
+		if got := fmt.Sprint(calls); got != test.want {
+			t.Errorf("%s (admin=%v): got calls %s, want %s", test.path, test.admin, got, test.want)
+		}
+	}
+}
+
+func TestServerListen(t *testing.T) {
+	tests := []struct {
+		network string // Server.DefaultNetwork
+		addr    string
+		want    string // network of the listener, or "" if it must fail
+	}{
+		{"", "127.0.0.1:0", "tcp"},
+		{"", "tcp4!127.0.0.1:0", "tcp"},
+		{"", "0", "tcp"},
+		{"tcp4", "localhost:0", "tcp"},
+		{"", "localhost", ""},
+		{"", "bogus!localhost:0", ""},
+	}
+	for _, test := range tests {
+		s := NewServer()
+		s.DefaultNetwork = test.network
+		l, err := s.listen(test.addr)
+		if test.want == "" {
+			if err == nil || !strings.Contains(err.Error(), test.addr) {
+				t.Errorf("listen(%q): got error %v, want an error with the address", test.addr, err)
+			}
+			if l != nil {
+				l.Close()
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("listen(%q): %v", test.addr, err)
+			continue
+		}
+		if l.Addr().Network() != test.want {
+			t.Errorf("listen(%q): got network %q, want %q", test.addr, l.Addr().Network(), test.want)
+		}
+		if test.network == "tcp4" && l.Addr().(*net.TCPAddr).IP.To4() == nil {
+			t.Errorf("listen(%q) with DefaultNetwork tcp4: got address %v", test.addr, l.Addr())
+		}
+		l.Close()
+	}
+}
+
+func TestRequestPreferredLanguage(t *testing.T) {
+	tests := []struct {
+		accept    string
+		supported []string
+		want      string
+	}{
+		{"", []string{"en", "es"}, "en"},
+		{"es-ES, es;q=0.9, en;q=0.8", []string{"en", "es"}, "es"},
+		{"fr, en-GB;q=0.5", []string{"es", "en"}, "en"},
+		{"es;q=0.5, en-US", []string{"es-ES", "en-US"}, "en-US"},
+		{"de, *;q=0.1", []string{"en", "fr"}, "en"},
+		{"de, en;q=0", []string{"fr", "en"}, "fr"},
+		{"en", nil, ""},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		if test.accept != "" {
+			r.Header.Set("Accept-Language", test.accept)
+		}
+		if got := (&Request{r}).PreferredLanguage(test.supported...); got != test.want {
+			t.Errorf("PreferredLanguage(%q) with %q: got %q, want %q", test.supported, test.accept, got, test.want)
+		}
+	}
+}
+
+func TestServerListenFD(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	f, err := l.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	s := NewServer()
+	fl, err := s.listen(fmt.Sprintf("fd!%d", f.Fd()))
+	if err != nil {
+		t.Fatalf("listen fd: %v", err)
+	}
+	defer fl.Close()
+	if fl.Addr().String() != l.Addr().String() {
+		t.Errorf("listen fd: got address %v, want %v", fl.Addr(), l.Addr())
+	}
+
+	t.Setenv("LISTEN_PID", "")
+	if _, err := s.listen("systemd!0"); err == nil {
+		t.Errorf("listen systemd: expected an error without LISTEN_PID")
+	}
+}
+
+func TestRequireContentLength(t *testing.T) {
+	s := NewServer()
+	s.HandleWith("/ingest", func(_ *Request, v map[string]int) (string, error) {
+		return "ok", nil
+	}, WithMiddleware(RequireContentLength()))
+
+	r := httptest.NewRequest("POST", "/ingest", strings.NewReader(`{"a": 1}`))
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Errorf("with Content-Length: got %d, want %d", w.Code, http.StatusOK)
+	}
+
+	r = httptest.NewRequest("POST", "/ingest", strings.NewReader(`{"a": 1}`))
+	r.ContentLength = -1
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+	if w.Code != http.StatusLengthRequired {
+		t.Errorf("without Content-Length: got %d, want %d", w.Code, http.StatusLengthRequired)
+	}
+}
+
+func TestServerSetConcurrent(t *testing.T) {
+	s := NewServer()
+	s.Set("n", 0)
+	s.Handle("/n", func(r *Request) (int, error) { return r.Get("n").(int), nil })
+
+	var wg sync.WaitGroup
+	for i := 1; i <= 10; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			s.Set("n", i)
+		}()
+		go func() {
+			defer wg.Done()
+			s.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/n", nil))
+		}()
+	}
+	wg.Wait()
+	if n, ok := s.Get("n").(int); !ok || n < 1 || n > 10 {
+		t.Errorf("Get: got %v", s.Get("n"))
+	}
+}
+
+func TestRequestSetIsolation(t *testing.T) {
+	s := NewServer()
+	s.Set("app", "demo")
+	s.Handle("/values", func(r *Request) (map[string]any, error) {
+		out := map[string]any{"app": r.Get("app"), "user": r.Get("user")}
+		ctx := r.Context()
+		r.Set("user", r.URL.Query().Get("user"))
+		r.Set("app", "changed")
+		if r.Context() != ctx {
+			return nil, errors.New("Request.Set changed the context")
+		}
+		return out, nil
+	})
+	for _, user := range []string{"alice", "bob"} {
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, httptest.NewRequest("GET", "/values?user="+user, nil))
+		if got, want := strings.TrimSpace(w.Body.String()), `{"app":"demo","user":null}`; got != want {
+			t.Errorf("request from %s: got %s, want %s", user, got, want)
+		}
+	}
+	if got := s.Get("app"); got != "demo" {
+		t.Errorf("Server.Get: got %v, want demo", got)
+	}
+}
+
+func TestOutputBytesContentType(t *testing.T) {
+	png := []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR")
+	s := NewServer()
+	s.Handle("/image", func(*Request) ([]byte, error) { return png, nil })
+	s.Handle("/page", func(*Request) ([]byte, error) { return []byte("<!DOCTYPE html><p>hi</p>"), nil })
+	s.HandleWith("/custom", func(*Request) ([]byte, error) { return png, nil },
+		WithMiddleware(func(next http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/x-custom")
+				next.ServeHTTP(w, r)
+			})
+		}))
+
+	for path, want := range map[string]string{
+		"/image":  "image/png",
+		"/page":   "text/html; charset=utf-8",
+		"/custom": "application/x-custom",
+	} {
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		if got := w.Header().Get("Content-Type"); got != want {
+			t.Errorf("%s: got Content-Type %q, want %q", path, got, want)
+		}
+	}
+}
+
+func TestHTTPErrorDetail(t *testing.T) {
+	s := NewServer()
+	s.Handle("POST /users", func(*Request) (string, error) {
+		return "", HTTPErrorDetail(http.StatusUnprocessableEntity, map[string]any{
+			"error":  "validation",
+			"fields": map[string]string{"email": "required"},
+		})
+	})
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("POST", "/users", nil))
+	want := `{"error":"validation","fields":{"email":"required"}}`
+	if w.Code != http.StatusUnprocessableEntity || strings.TrimSpace(w.Body.String()) != want {
+		t.Errorf("got %d %s, want %d %s", w.Code, w.Body.String(), http.StatusUnprocessableEntity, want)
+	}
+}
+
+func TestRegisterErrorStatus(t *testing.T) {
+	errQuota := errors.New("quota exceeded")
+	RegisterErrorStatus(errQuota, http.StatusPaymentRequired)
+
+	tests := []struct {
+		err  error
+		want int
+	}{
+		{fmt.Errorf("query: %w", context.DeadlineExceeded), http.StatusGatewayTimeout},
+		{context.Canceled, 499},
+		{&os.PathError{Op: "open", Path: "/secret", Err: os.ErrPermission}, http.StatusForbidden},
+		{io.ErrUnexpectedEOF, http.StatusBadRequest},
+		{fmt.Errorf("upload: %w", errQuota), http.StatusPaymentRequired},
+		{HTTPError(http.StatusConflict, context.Canceled), http.StatusConflict},
+		{errors.New("other"), http.StatusBadRequest},
+	}
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		httpError(w, httptest.NewRequest("GET", "/", nil), test.err)
+		if w.Code != test.want {
+			t.Errorf("%v: got status %d, want %d", test.err, w.Code, test.want)
+		}
+	}
+}
+
+func TestErrorRequestID(t *testing.T) {
+	s := NewServer()
+	s.AddMiddleware(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if id := r.Header.Get("X-Request-ID"); id != "" {
+				(&Request{r}).Set(RequestIDKey, id)
+			}
+			next.ServeHTTP(w, r)
+		})
+	})
+	s.Handle("/fail", func(*Request) (string, error) { return "", errors.New("broken") })
+
+	for id, want := range map[string]string{
+		"":       `{"error":"broken"}`,
+		"abc-42": `{"error":"broken","request_id":"abc-42"}`,
+	} {
+		r := httptest.NewRequest("GET", "/fail", nil)
+		r.Header.Set("X-Request-ID", id)
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		var got, wantV map[string]string
+		json.Unmarshal(w.Body.Bytes(), &got)
+		json.Unmarshal([]byte(want), &wantV)
+		if fmt.Sprint(got) != fmt.Sprint(wantV) {
+			t.Errorf("request ID %q: got %s, want %s", id, w.Body.String(), want)
+		}
+	}
+
+	s.Handle("/control", func(*Request) (string, error) { return "", errors.New("bad \x01 <byte>") })
+	r := httptest.NewRequest("GET", "/control", nil)
+	r.Header.Set("X-Request-ID", "abc-42")
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+	var got struct{ Error string }
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil || got.Error != "bad \x01 <byte>" {
+		t.Errorf("control character: got %s (%v)", w.Body.String(), err)
+	}
+}
+
+type testSQLError string
+
+func (e testSQLError) Error() string    { return "SQL error " + string(e) }
+func (e testSQLError) SQLState() string { return string(e) }
+
+func TestSQLStateStatus(t *testing.T) {
+	for state, want := range map[string]int{
+		"23505": http.StatusConflict,
+		"23503": http.StatusConflict,
+		"23502": http.StatusBadRequest,
+		"42601": http.StatusBadRequest,
+	} {
+		w := httptest.NewRecorder()
+		httpError(w, httptest.NewRequest("POST", "/", nil), fmt.Errorf("insert: %w", testSQLError(state)))
+		if w.Code != want || !strings.HasPrefix(w.Header().Get("X-SQL-Error"), state) {
+			t.Errorf("SQLSTATE %s: got status %d and X-SQL-Error %q, want %d", state, w.Code, w.Header().Get("X-SQL-Error"), want)
+		}
+	}
+}
+
+func TestHandlePermsSlice(t *testing.T) {
+	perms := []func(*Request) bool{
+		func(r *Request) bool { return r.Header.Get("X-Admin") != "" },
+		func(r *Request) bool { return r.Header.Get("X-Owner") != "" },
+	}
+	s := NewServer()
+	s.Handle("/private", func(*Request) (string, error) { return "ok", nil }, perms...)
+
+	for header, want := range map[string]int{"": http.StatusUnauthorized, "X-Admin": http.StatusOK, "X-Owner": http.StatusOK} {
+		r := httptest.NewRequest("GET", "/private", nil)
+		if header != "" {
+			r.Header.Set(header, "1")
+		}
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		if w.Code != want {
+			t.Errorf("with header %q: got %d, want %d", header, w.Code, want)
+		}
+	}
+}
+
+func TestShutdownBeforeServe(t *testing.T) {
+	s := NewServer()
+	serve := func() chan error {
+		served := make(chan error, 1)
+		go func() {
+			served <- s.Serve("127.0.0.1:0")
+		}()
+		return served
+	}
+	wait := func(served chan error) {
+		select {
+		case err := <-served:
+			if !errors.Is(err, http.ErrServerClosed) {
+				t.Errorf("Serve: got %v, want %v", err, http.ErrServerClosed)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Serve did not return after Shutdown")
+		}
+	}
+	served := serve()
+	if err := s.Shutdown(context.Background()); err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+	wait(served)
+	wait(serve())
+}
+
+func TestErrorJSONOptions(t *testing.T) {
+	s := NewServer()
+	s.SetJSONOptions(JSONOptions{Indent: "  ", NoEscapeHTML: true})
+	s.Handle("/fail", func(*Request) (string, error) { return "", errors.New("bad <tag>") })
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("GET", "/fail", nil))
+	if want := "{\n  \"error\": \"bad <tag>\"\n}\n"; w.Body.String() != want {
+		t.Errorf("got %q, want %q", w.Body.String(), want)
+	}
+}
+
+func TestTimeoutMiddlewareSetCookie(t *testing.T) {
+	s := NewServer()
+	s.AddMiddleware(TimeoutMiddleware(20 * time.Millisecond))
+	var pattern string
+	s.OnRequestComplete(func(info RequestInfo) { pattern = info.Pattern })
+	s.Handle("GET /login/{speed}", func(w http.ResponseWriter, r *http.Request) {
+		req := &Request{r}
+		req.SetCookie(&http.Cookie{Name: "session", Value: "abc123"})
+		if req.Param("speed") == "slow" {
+			<-r.Context().Done()
+			req.SetCookie(&http.Cookie{Name: "late", Value: "1"})
+		}
+	})
+
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("GET", "/login/fast", nil))
+	if cookies := w.Result().Cookies(); w.Code != http.StatusOK || len(cookies) != 1 || cookies[0].Name != "session" {
+		t.Errorf("fast: got %d with cookies %v", w.Code, cookies)
+	}
+	if pattern != "GET /login/{speed}" {
+		t.Errorf("fast: got pattern %q", pattern)
+	}
+
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("GET", "/login/slow", nil))
+	if cookies := w.Result().Cookies(); w.Code != http.StatusServiceUnavailable || len(cookies) != 0 {
+		t.Errorf("slow: got %d with cookies %v", w.Code, cookies)
+	}
 }
@@ -0,0 +1,114 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// SSEWriter sends server-sent events to a client.
+//
+// By convention, interim events (sent with Progress) are named "progress",
+// and the final one (sent with Close) is named "done", so clients can
+// distinguish progress from completion.  These names can be changed
+// with the fields ProgressEvent and DoneEvent.
+type SSEWriter struct {
+	ProgressEvent string // Name of the events sent by Progress
+	DoneEvent     string // Name of the event sent by Close
+
+	w      http.ResponseWriter
+	r      *http.Request
+	closed bool
+}
+
+var errSSEClosed = errors.New("api: SSE stream already closed")
+
+// Send sends an event with the given name (which can be empty) and data.
+// Strings and []byte are sent as they are; other types are JSON-encoded.
+// It returns an error if the client has disconnected.
+func (s *SSEWriter) Send(event string, data any) error {
+	if s.closed {
+		return errSSEClosed
+	}
+	if err := s.r.Context().Err(); err != nil {
+		return err
+	}
+	var b []byte
+	switch d := data.(type) {
+	case string:
+		b = []byte(d)
+	case []byte:
+		b = d
+	default:
+		var err error
+		if b, err = json.Marshal(data); err != nil {
+			return err
+		}
+	}
+	var buf bytes.Buffer
+	if event != "" {
+		fmt.Fprintf(&buf, "event: %s\n", event)
+	}
+	for _, line := range bytes.Split(b, []byte("\n")) {
+		fmt.Fprintf(&buf, "data: %s\n", line)
+	}
+	buf.WriteString("\n")
+	if _, err := s.w.Write(buf.Bytes()); err != nil {
+		return err
+	}
+	return http.NewResponseController(s.w).Flush()
+}
+
+// Done returns a channel which is closed when the client disconnects,
+// so handlers waiting for new events can return:
+//
+//	for {
+//		select {
+//		case ev := <-updates:
+//			sse.Progress(ev)
+//		case <-sse.Done():
+//			return nil
+//		}
+//	}
+func (s *SSEWriter) Done() <-chan struct{} {
+	return s.r.Context().Done()
+}
+
+// Progress sends an interim event, named after ProgressEvent.
+func (s *SSEWriter) Progress(data any) error {
+	return s.Send(s.ProgressEvent, data)
+}
+
+// Close sends the final result as an event named after DoneEvent,
+// and ends the stream: no more events can be sent after it.
+func (s *SSEWriter) Close(final any) error {
+	err := s.Send(s.DoneEvent, final)
+	s.closed = true
+	return err
+}
+
+// HandlerSSE returns a handler which sends a stream of server-sent events,
+// produced by calling handler.
+//
+// If handler returns an error and the stream has not been closed,
+// the error is sent as an event named "error".
+func HandlerSSE(handler func(*Request, *SSEWriter) error) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.WriteHeader(http.StatusOK)
+		http.NewResponseController(w).Flush()
+
+		sse := &SSEWriter{
+			ProgressEvent: "progress",
+			DoneEvent:     "done",
+			w:             w,
+			r:             r,
+		}
+		if err := handler(&Request{r}, sse); err != nil && !sse.closed && r.Context().Err() == nil {
+			sse.Send("error", map[string]string{"error": err.Error()})
+		}
+	})
+}
@@ -0,0 +1,170 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"net"
+	"net/url"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+// Conn represents a Websocket connection.
+type Conn struct {
+	conn                  *websocket.Conn
+	disallowUnknownFields bool // set from the Client in WS
+}
+
+// Read implements the io.Reader interface: it reads data of a frame from
+// the WebSocket connection. if msg is not large enough for the frame data,
+// it fills the msg and next Read will read the rest of the frame data.
+// it reads Text frame or Binary frame.
+func (ws *Conn) Read(msg []byte) (n int, err error) {
+	return ws.conn.Read(msg)
+}
+
+// Write implements the io.Writer interface: it writes data as a frame to the
+// WebSocket connection.
+func (ws *Conn) Write(msg []byte) (n int, err error) {
+	return ws.conn.Write(msg)
+}
+
+// Close closes the WebSocket connection.
+func (ws *Conn) Close() error {
+	return ws.conn.Close()
+}
+
+// SendJSON sends v as a JSON-encoded text frame.
+func (ws *Conn) SendJSON(v any) error {
+	return websocket.JSON.Send(ws.conn, v)
+}
+
+// ReceiveJSON receives a frame and decodes it as JSON into v.
+//
+// If the connection was opened by a Client with DisallowUnknownFields,
+// it returns an error when v is a struct and the frame contains
+// object keys which do not match any field.
+func (ws *Conn) ReceiveJSON(v any) error {
+	if !ws.disallowUnknownFields {
+		return websocket.JSON.Receive(ws.conn, v)
+	}
+	var msg []byte
+	if err := websocket.Message.Receive(ws.conn, &msg); err != nil {
+		return err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(msg))
+	decoder.DisallowUnknownFields()
+	return decoder.Decode(v)
+}
+
+// SetReadDeadline sets the deadline for future Read and ReceiveJSON calls.
+// A zero value for t means they will not time out.
+func (ws *Conn) SetReadDeadline(t time.Time) error {
+	return ws.conn.SetReadDeadline(t)
+}
+
+// SetWriteDeadline sets the deadline for future Write and SendJSON calls.
+// A zero value for t means they will not time out.
+func (ws *Conn) SetWriteDeadline(t time.Time) error {
+	return ws.conn.SetWriteDeadline(t)
+}
+
+// ReceiveContext is like ReceiveJSON, but it returns ctx.Err()
+// if ctx is done before receiving a frame.
+// After that, part of a frame may have been read,
+// so the connection should be closed.
+func (ws *Conn) ReceiveContext(ctx context.Context, v any) error {
+	stop := context.AfterFunc(ctx, func() {
+		ws.conn.SetReadDeadline(time.Now())
+	})
+	err := ws.ReceiveJSON(v)
+	if !stop() {
+		ws.conn.SetReadDeadline(time.Time{})
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+	}
+	return err
+}
+
+// WS opens a WebSocket connection to the API,
+// using the same URL, token and headers as the HTTP requests.
+// The caller must close the connection.
+func (c *Client) WS(URL string, opts ...RequestOption) (*Conn, error) {
+	return c.WSContext(context.Background(), URL, opts...)
+}
+
+// WSContext is like WS, using the provided context to establish the connection.
+func (c *Client) WSContext(ctx context.Context, URL string, opts ...RequestOption) (*Conn, error) {
+	c = c.with(opts)
+	u, header, err := c.urlAndHeader(URL)
+	if err != nil {
+		return nil, err
+	}
+	origin := url.URL{Scheme: u.Scheme, Host: u.Host}
+	switch u.Scheme {
+	case "http":
+		u.Scheme = "ws"
+	case "https":
+		u.Scheme = "wss"
+	}
+	config, err := websocket.NewConfig(u.String(), origin.String())
+	if err != nil {
+		return nil, err
+	}
+	config.Header = header
+
+	conn, err := c.dialWS(ctx, u)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+	stop := context.AfterFunc(ctx, func() {
+		conn.Close()
+	})
+	defer stop()
+	if c.timeout != 0 {
+		conn.SetDeadline(time.Now().Add(c.timeout))
+		defer conn.SetDeadline(time.Time{})
+	}
+	ws, err := websocket.NewClient(config, conn)
+	if err != nil {
+		conn.Close()
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+	return &Conn{conn: ws, disallowUnknownFields: c.disallowUnknownFields}, nil
+}
+
+// dialWS opens the network connection for a WebSocket to u.
+func (c *Client) dialWS(ctx context.Context, u *url.URL) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: c.dialTimeout}
+	if c.unixSocket != "" {
+		return dialer.DialContext(ctx, "unix", c.unixSocket)
+	}
+	addr := u.Host
+	if u.Port() == "" {
+		port := "80"
+		if u.Scheme == "wss" {
+			port = "443"
+		}
+		addr = net.JoinHostPort(u.Hostname(), port)
+	}
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil || u.Scheme != "wss" {
+		return conn, err
+	}
+	tlsConn := tls.Client(conn, &tls.Config{ServerName: u.Hostname()})
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}